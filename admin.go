@@ -0,0 +1,195 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   Admin endpoints of the PubSub server. They live under /admin/ and are served by their
+   own router, as httprouter does not allow them next to the /:topic_name wildcard.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/nakdesai/pub-sub/broker"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// json representation of a topic config, durations are strings like "1m30s". A DedupWindow
+// of "off" turns the deduplication off.
+type topicConfig struct {
+	MaxBacklog  int
+	Retention   string
+	TTL         string
+	Overflow    broker.OverflowPolicy
+	AckTimeout  string
+	DedupWindow string
+	AutoCreate  bool
+}
+
+// parse a duration, the empty string is 0
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(s)
+}
+
+// format a duration, 0 is the empty string
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+
+	return d.String()
+}
+
+// parse the durations of a topic config
+func (tc topicConfig) parse() (broker.TopicConfig, error) {
+	config := broker.TopicConfig{MaxBacklog: tc.MaxBacklog, Overflow: tc.Overflow, AutoCreate: tc.AutoCreate}
+
+	dedupWindow := tc.DedupWindow
+
+	if dedupWindow == "off" {
+		dedupWindow = broker.NO_DEDUP.String()
+	}
+
+	for _, d := range []struct {
+		s string
+		d *time.Duration
+	}{
+		{tc.Retention, &config.Retention},
+		{tc.TTL, &config.TTL},
+		{tc.AckTimeout, &config.AckTimeout},
+		{dedupWindow, &config.DedupWindow},
+	} {
+		var err error
+
+		if *d.d, err = parseDuration(d.s); err != nil {
+			return config, err
+		}
+	}
+
+	return config, nil
+}
+
+// create a topic
+func createTopic(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if reservedTopics[params.ByName("topic_name")] {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var req topicConfig
+
+	// the body is optional, an empty body creates the topic with the default config
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	config, err := req.parse()
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := pb.CreateTopic(params.ByName("topic_name"), config); err != nil {
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// delete a topic
+func deleteTopic(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if err := pb.DeleteTopic(params.ByName("topic_name")); err != nil {
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// get the config of a topic
+func getTopic(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	config, err := pb.GetTopicConfig(params.ByName("topic_name"))
+
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+
+	dedupWindow := formatDuration(config.DedupWindow)
+
+	if config.DedupWindow < 0 {
+		dedupWindow = "off"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(topicConfig{
+		MaxBacklog:  config.MaxBacklog,
+		Retention:   formatDuration(config.Retention),
+		TTL:         formatDuration(config.TTL),
+		Overflow:    config.Overflow,
+		AckTimeout:  formatDuration(config.AckTimeout),
+		DedupWindow: dedupWindow,
+		AutoCreate:  config.AutoCreate,
+	})
+}
+
+// list the topics
+func listTopics(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	topics, err := pb.ListTopics()
+
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+
+	if topics == nil {
+		topics = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(topics)
+}
+
+// router for the admin endpoints
+func newAdminRouter() *httprouter.Router {
+	router := httprouter.New()
+	router.GET("/admin/topics", logged(listTopics))
+	router.PUT("/admin/topics/:topic_name", logged(createTopic))
+	router.GET("/admin/topics/:topic_name", logged(getTopic))
+	router.DELETE("/admin/topics/:topic_name", logged(deleteTopic))
+	router.GET("/admin/rules", logged(listRules))
+	router.PUT("/admin/rules/:rule_name", logged(putRule))
+	router.DELETE("/admin/rules/:rule_name", logged(deleteRule))
+	router.PUT("/admin/schemas/:topic_name", logged(putSchema))
+	router.GET("/admin/schemas/:topic_name", logged(getSchema))
+	router.GET("/admin/schemas/:topic_name/:version", logged(getSchema))
+	router.POST("/admin/reload", logged(reloadConfig))
+
+	return router
+}
@@ -0,0 +1,74 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   Bearer token authentication of the PubSub server (Authorization: Bearer <token>). The
+   tokens come from the Auth settings (they can change on reload), without any token every
+   request is accepted. The health endpoints are never authenticated.
+
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// check if token is one of the tokens
+func validToken(token string, tokens []string) bool {
+	found := false
+
+	// compare with every token, in constant time
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			found = true
+		}
+	}
+
+	return found
+}
+
+// refuse the requests without a valid token with 401, and the admin requests with a token
+// that is not an admin token with 403
+func authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := currentConfig().Auth
+
+		if len(auth.Tokens) == 0 && len(auth.AdminTokens) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		if !found || !(validToken(token, auth.Tokens) || validToken(token, auth.AdminTokens)) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		admin := strings.HasPrefix(r.URL.Path, "/admin/")
+
+		if admin && len(auth.AdminTokens) > 0 && !validToken(token, auth.AdminTokens) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,243 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   The broker package defines the API shared by the PubSub implementations (pubsub and
+   pubsubScalable): the Broker interface, the message and topic config types and the errors.
+   The implementations alias these types, so values and errors can be used interchangeably.
+
+   Any backend implementing Broker can check that it behaves like the built-in ones with
+   the conformance tests of the brokertest package.
+
+*/
+
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// message carrying a payload of type T
+type Message[T any] struct {
+	Message   T
+	Published time.Time
+	// messages sharing a key are delivered to a subscription one at a time, in publish order
+	Key string `json:",omitempty"`
+	// from 0 to MAX_PRIORITY, the highest priority is delivered first
+	Priority int `json:",omitempty"`
+	// a publish with a key already seen within the dedup window of the topic is dropped
+	IdempotencyKey string `json:",omitempty"`
+	// topic to publish the reply of a request to, set by Request
+	ReplyTo string `json:",omitempty"`
+	// identifies the request a reply answers, the responder copies it from the request
+	CorrelationID string `json:",omitempty"`
+	// W3C trace context of the message
+	TraceParent string `json:",omitempty"`
+	// assigned on publish, unique within the topic. A dropped duplicate gets the id of the original.
+	ID uint64
+}
+
+// the highest message priority
+const MAX_PRIORITY = 9
+
+// DedupWindow of a topic that does not deduplicate its publishes
+const NO_DEDUP time.Duration = -1
+
+// publisher message struct, the message type of the HTTP server
+type PubMessage = Message[string]
+
+// a pubsub carrying messages with a payload of type T
+type Broker[T any] interface {
+	// subscribe to a topic, creating it if auto creation is allowed
+	Subscribe(topicName, subscriberName string) error
+	// unsubscribe from a topic
+	UnSubscribe(topicName, subscriberName string) error
+	// publish a message to a topic, creating it if auto creation is allowed
+	Publish(topicName string, msg *Message[T]) error
+	// pull the next message of a subscriber
+	Get(topicName, subscriberName string) (*Message[T], error)
+	// publish several messages to a topic at once, all or none with the Reject overflow policy
+	PublishBatch(topicName string, msgs []*Message[T]) error
+	// publish messages to several topics (by topic name), all of them or none
+	PublishAtomic(batches map[string][]*Message[T]) error
+	// publish a request to a topic and wait for the reply published to its ReplyTo topic until ctx is done
+	Request(ctx context.Context, topicName string, msg *Message[T]) (*Message[T], error)
+	// add or replace a named rule forwarding the messages published to a topic to another topic
+	SetForwardingRule(name string, rule ForwardingRule[T]) error
+	// delete a forwarding rule
+	DeleteForwardingRule(name string) error
+	// return the forwarding rules by name
+	ForwardingRules() (map[string]ForwardingRule[T], error)
+	// add interceptors at the end of the interceptor chain
+	Use(interceptors ...Interceptor[T])
+	// acknowledge a message with an ordering key so the next one with the same key is delivered
+	Ack(topicName, subscriberName string, id uint64) error
+	// pull up to max messages of a subscriber at once
+	GetN(topicName, subscriberName string, max int) ([]*Message[T], error)
+	// pull the next message of a subscriber, blocking until one is published, ctx is done or the broker is closed
+	Receive(ctx context.Context, topicName, subscriberName string) (*Message[T], error)
+	// stream the messages of a subscriber, the channel is closed once ctx is done or Receive fails
+	Messages(ctx context.Context, topicName, subscriberName string) <-chan *Message[T]
+	// push the messages of a subscriber to handler, see ConsumeOptions
+	Consume(topicName, subscriberName string, handler Handler[T], opts ConsumeOptions) (Consumer, error)
+	// create a topic with its own settings
+	CreateTopic(topicName string, config TopicConfig) error
+	// delete a topic along with its subscribers and pending messages
+	DeleteTopic(topicName string) error
+	// list the names of the existing topics in alphabetical order
+	ListTopics() ([]string, error)
+	// return the settings of a topic
+	GetTopicConfig(topicName string) (TopicConfig, error)
+	// change the settings of a topic, its subscribers and pending messages are kept
+	SetTopicConfig(topicName string, config TopicConfig) error
+	// check that the broker answers requests before ctx is done (ErrClosed once closed)
+	Ping(ctx context.Context) error
+	// refuse new requests, drain the pending ones until ctx is done and release the resources
+	Close(ctx context.Context) error
+}
+
+// function processing a message pushed by Consume. Returning nil acknowledges the
+// message, an error (or a panic) hands it back to the subscriber to be retried (the next
+// messages with the same ordering key wait until it is handled or dropped).
+type Handler[T any] func(ctx context.Context, msg *Message[T]) error
+
+// settings of a consumer
+type ConsumeOptions struct {
+	// number of messages handled concurrently, 0 handles one at a time
+	Concurrency int
+	// deliveries of a failing message before it is dropped, 0 retries forever
+	MaxAttempts int
+	// wait before a failed message is retried
+	RetryDelay time.Duration
+	// called when the handler fails, with the number of the attempt and whether the message is dropped
+	OnError func(err error, attempt int, dropped bool)
+}
+
+// a rule forwarding the messages published to its source topic to its destination topic.
+// Forwarding is best effort, a destination that does not exist or is full is skipped, and a
+// rule that would make messages go round in a cycle is refused with ErrForwardingLoop.
+type ForwardingRule[T any] struct {
+	Source      string
+	Destination string
+	// forward only the messages it returns true for, nil forwards every message
+	Filter func(msg *Message[T]) bool
+	// rewrite the copy of the message forwarded, nil forwards it unchanged
+	Transform func(msg *Message[T])
+}
+
+// a running Consume
+type Consumer interface {
+	// stop pulling messages and wait for the handlers in flight. Their context is
+	// cancelled once ctx is done, the messages they fail on are retried by the next consumer.
+	Stop(ctx context.Context) error
+	// closed once the consumer has stopped, on Stop or when its subscription goes away
+	Done() <-chan struct{}
+	// why the consumer stopped on its own (ErrClosed, ErrTopicNotFound...), nil after Stop
+	Err() error
+}
+
+var (
+	ErrSubNotFound           = errors.New("Subscriber Not Found")
+	ErrTopicNotFound         = errors.New("Topic Not Found")
+	ErrNoNewMessages         = errors.New("No New Messages for Subscriber")
+	ErrTopicExists           = errors.New("Topic Already Exists")
+	ErrInvalidTopicConfig    = errors.New("Invalid Topic Config")
+	ErrSubscriberExists      = errors.New("Subscriber Already Exists")
+	ErrQueueFull             = errors.New("Topic Queue Full")
+	ErrClosed                = errors.New("PubSub Closed")
+	ErrInvalidConsumeOptions = errors.New("Invalid Consume Options")
+	ErrInvalidBatch          = errors.New("Invalid Batch")
+	ErrMessageNotFound       = errors.New("Message Not Found")
+	ErrInvalidPriority       = errors.New("Invalid Priority")
+	ErrInvalidRule           = errors.New("Invalid Forwarding Rule")
+	ErrRuleNotFound          = errors.New("Forwarding Rule Not Found")
+	ErrForwardingLoop        = errors.New("Forwarding Rules Form a Loop")
+	ErrRejected              = errors.New("Message Rejected")
+)
+
+// what happens when a message is published to a topic whose backlog is full
+type OverflowPolicy int
+
+const (
+	// overwrite the oldest message, subscribers that did not pull it yet lose it
+	DropOldest OverflowPolicy = iota
+	// discard the new message until the slowest subscriber catches up
+	DropNewest
+	// like DropNewest, but Publish returns ErrQueueFull
+	Reject
+)
+
+// per-topic settings
+type TopicConfig struct {
+	// maximum number of messages retained for the subscribers, 0 uses the default backlog
+	MaxBacklog int
+	// messages older than this are not delivered, 0 retains them until they are overwritten
+	Retention time.Duration
+	// the topic is deleted after being idle (no subscribe, publish or get) for this long, 0 never expires
+	TTL time.Duration
+	// what to do when the backlog is full
+	Overflow OverflowPolicy
+	// a message with an ordering key not acked for this long is delivered again, 0 waits for the ack forever
+	AckTimeout time.Duration
+	// how long the idempotency keys of the published messages are remembered, 0 uses the default
+	// window and a negative one (NO_DEDUP) turns the deduplication off
+	DedupWindow time.Duration
+	// allow Subscribe and Publish to create the topic again with these settings once it has
+	// expired. A topic that never existed is created if the default config allows it.
+	AutoCreate bool
+}
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop_oldest"
+	case DropNewest:
+		return "drop_newest"
+	case Reject:
+		return "reject"
+	}
+
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
+// encode the policy by name (used for json)
+func (p OverflowPolicy) MarshalText() ([]byte, error) {
+	switch p {
+	case DropOldest, DropNewest, Reject:
+		return []byte(p.String()), nil
+	}
+
+	return nil, fmt.Errorf("invalid overflow policy %d", int(p))
+}
+
+// decode the policy from its name
+func (p *OverflowPolicy) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "drop_oldest", "":
+		*p = DropOldest
+	case "drop_newest":
+		*p = DropNewest
+	case "reject":
+		*p = Reject
+	default:
+		return fmt.Errorf("invalid overflow policy %q", text)
+	}
+
+	return nil
+}
@@ -0,0 +1,1451 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   The brokertest package contains the conformance tests of the broker.Broker interface.
+   Every backend runs them to prove it has the same semantics as the built-in ones:
+
+   func TestConformance(t *testing.T) {
+       brokertest.Run(t, func(t *testing.T) broker.Broker[string] {
+           return mybackend.New()
+       })
+   }
+
+   The brokers returned by newBroker must auto create topics and have a default backlog
+   of at least 10 messages.
+
+*/
+
+package brokertest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nakdesai/pub-sub/broker"
+)
+
+// a conformance test, it gets a new broker that is closed once it returns
+type conformanceTest struct {
+	name string
+	run  func(t *testing.T, b broker.Broker[string])
+}
+
+var conformanceTests = []conformanceTest{
+	{"PublishGet", testPublishGet},
+	{"Errors", testErrors},
+	{"TopicLifecycle", testTopicLifecycle},
+	{"SetTopicConfig", testSetTopicConfig},
+	{"Overflow", testOverflow},
+	{"Retention", testRetention},
+	{"TopicTTL", testTopicTTL},
+	{"ConcurrentPublish", testConcurrentPublish},
+	{"Batch", testBatch},
+	{"PublishAtomic", testPublishAtomic},
+	{"Receive", testReceive},
+	{"ReceiveCancel", testReceiveCancel},
+	{"ReceiveUnblock", testReceiveUnblock},
+	{"Messages", testMessages},
+	{"OrderingKeys", testOrderingKeys},
+	{"AckTimeout", testAckTimeout},
+	{"Priorities", testPriorities},
+	{"PriorityStarvation", testPriorityStarvation},
+	{"PriorityBacklog", testPriorityBacklog},
+	{"Dedup", testDedup},
+	{"RequestReply", testRequestReply},
+	{"Forwarding", testForwarding},
+	{"Interceptors", testInterceptors},
+	{"Validate", testValidate},
+	{"Consume", testConsume},
+	{"ConsumeRetry", testConsumeRetry},
+	{"ConsumeStop", testConsumeStop},
+	{"ConsumeOrdering", testConsumeOrdering},
+	{"Ping", testPing},
+	{"Close", testClose},
+}
+
+// run the conformance tests, each one against a new broker returned by newBroker
+func Run(t *testing.T, newBroker func(t *testing.T) broker.Broker[string]) {
+	for _, ct := range conformanceTests {
+		t.Run(ct.name, func(t *testing.T) {
+			b := newBroker(t)
+			defer b.Close(context.Background())
+
+			ct.run(t, b)
+		})
+	}
+}
+
+func newMessage(msg string) *broker.PubMessage {
+	return &broker.PubMessage{Message: msg, Published: time.Now()}
+}
+
+// check the next message of a subscriber
+func expectMessage(t *testing.T, b broker.Broker[string], topicName, subscriberName, want string) {
+	t.Helper()
+
+	msg, err := b.Get(topicName, subscriberName)
+
+	if err != nil {
+		t.Errorf("%s/%s: expected message %q, got error %v", topicName, subscriberName, want, err)
+	} else if msg.Message != want {
+		t.Errorf("%s/%s: expected message %q, got %q", topicName, subscriberName, want, msg.Message)
+	}
+}
+
+// check the error returned by an operation
+func expectError(t *testing.T, op string, got, want error) {
+	t.Helper()
+
+	if got != want {
+		t.Errorf("%s: expected error %v, got %v", op, want, got)
+	}
+}
+
+// every subscriber gets every message in order, new subscribers only get new messages
+func testPublishGet(t *testing.T, b broker.Broker[string]) {
+	for _, sub := range []string{"sub1", "sub2"} {
+		expectError(t, "Subscribe", b.Subscribe("topic", sub), nil)
+	}
+
+	expectError(t, "Publish", b.Publish("topic", newMessage("msg1")), nil)
+	expectError(t, "Publish", b.Publish("topic", newMessage("msg2")), nil)
+
+	expectError(t, "Subscribe", b.Subscribe("topic", "sub3"), nil)
+	expectError(t, "Publish", b.Publish("topic", newMessage("msg3")), nil)
+
+	for _, sub := range []string{"sub1", "sub2"} {
+		expectMessage(t, b, "topic", sub, "msg1")
+		expectMessage(t, b, "topic", sub, "msg2")
+		expectMessage(t, b, "topic", sub, "msg3")
+	}
+
+	expectMessage(t, b, "topic", "sub3", "msg3")
+
+	_, err := b.Get("topic", "sub1")
+	expectError(t, "Get", err, broker.ErrNoNewMessages)
+}
+
+// the errors of the subscriber operations
+func testErrors(t *testing.T, b broker.Broker[string]) {
+	expectError(t, "Subscribe", b.Subscribe("topic", "sub1"), nil)
+	expectError(t, "Subscribe twice", b.Subscribe("topic", "sub1"), broker.ErrSubscriberExists)
+	expectError(t, "UnSubscribe unknown subscriber", b.UnSubscribe("topic", "sub2"), broker.ErrSubNotFound)
+	expectError(t, "UnSubscribe unknown topic", b.UnSubscribe("missing", "sub1"), broker.ErrTopicNotFound)
+
+	_, err := b.Get("topic", "sub2")
+	expectError(t, "Get unknown subscriber", err, broker.ErrSubNotFound)
+
+	_, err = b.Get("missing", "sub1")
+	expectError(t, "Get unknown topic", err, broker.ErrTopicNotFound)
+
+	expectError(t, "UnSubscribe", b.UnSubscribe("topic", "sub1"), nil)
+
+	_, err = b.Get("topic", "sub1")
+	expectError(t, "Get after UnSubscribe", err, broker.ErrSubNotFound)
+}
+
+// explicit topic creation, listing, config and deletion
+func testTopicLifecycle(t *testing.T, b broker.Broker[string]) {
+	config := broker.TopicConfig{MaxBacklog: 5, Retention: time.Hour, Overflow: broker.DropNewest}
+
+	expectError(t, "CreateTopic", b.CreateTopic("orders", config), nil)
+	expectError(t, "CreateTopic twice", b.CreateTopic("orders", broker.TopicConfig{}), broker.ErrTopicExists)
+	expectError(t, "CreateTopic invalid", b.CreateTopic("bad", broker.TopicConfig{TTL: -1}), broker.ErrInvalidTopicConfig)
+
+	// topics are created implicitly too
+	expectError(t, "Subscribe", b.Subscribe("audit", "sub1"), nil)
+	expectError(t, "Publish", b.Publish("billing", newMessage("msg")), nil)
+
+	topics, err := b.ListTopics()
+
+	if err != nil || fmt.Sprint(topics) != "[audit billing orders]" {
+		t.Errorf("ListTopics: expected [audit billing orders], got %v, %v", topics, err)
+	}
+
+	got, err := b.GetTopicConfig("orders")
+
+	if err != nil || got.MaxBacklog != 5 || got.Retention != time.Hour || got.Overflow != broker.DropNewest {
+		t.Errorf("GetTopicConfig: expected %+v, got %+v, %v", config, got, err)
+	}
+
+	// a zero backlog takes the default
+	if got, _ := b.GetTopicConfig("audit"); got.MaxBacklog <= 0 {
+		t.Errorf("GetTopicConfig: default backlog not applied, got %+v", got)
+	}
+
+	expectError(t, "DeleteTopic", b.DeleteTopic("orders"), nil)
+	expectError(t, "DeleteTopic twice", b.DeleteTopic("orders"), broker.ErrTopicNotFound)
+
+	_, err = b.GetTopicConfig("orders")
+	expectError(t, "GetTopicConfig deleted", err, broker.ErrTopicNotFound)
+}
+
+// a topic reconfigured keeps its subscribers and messages
+func testSetTopicConfig(t *testing.T, b broker.Broker[string]) {
+	b.CreateTopic("orders", broker.TopicConfig{MaxBacklog: 2, Overflow: broker.Reject})
+	b.Subscribe("orders", "sub1")
+	b.Publish("orders", newMessage("msg1"))
+	b.Publish("orders", newMessage("msg2"))
+	expectError(t, "Publish full", b.Publish("orders", newMessage("msg3")), broker.ErrQueueFull)
+
+	expectError(t, "SetTopicConfig", b.SetTopicConfig("orders", broker.TopicConfig{MaxBacklog: 3, Overflow: broker.Reject}), nil)
+	expectError(t, "Publish after growing", b.Publish("orders", newMessage("msg3")), nil)
+	expectError(t, "Publish full", b.Publish("orders", newMessage("msg4")), broker.ErrQueueFull)
+
+	if got, err := b.GetTopicConfig("orders"); err != nil || got.MaxBacklog != 3 {
+		t.Errorf("GetTopicConfig: expected a backlog of 3, got %+v, %v", got, err)
+	}
+
+	// shrinking drops the oldest messages
+	expectError(t, "SetTopicConfig", b.SetTopicConfig("orders", broker.TopicConfig{MaxBacklog: 2}), nil)
+	expectMessage(t, b, "orders", "sub1", "msg2")
+	expectMessage(t, b, "orders", "sub1", "msg3")
+
+	expectError(t, "SetTopicConfig missing", b.SetTopicConfig("missing", broker.TopicConfig{}), broker.ErrTopicNotFound)
+	expectError(t, "SetTopicConfig invalid", b.SetTopicConfig("orders", broker.TopicConfig{MaxBacklog: -1}), broker.ErrInvalidTopicConfig)
+}
+
+// the overflow policies of a full backlog
+func testOverflow(t *testing.T, b broker.Broker[string]) {
+	for _, policy := range []broker.OverflowPolicy{broker.DropOldest, broker.DropNewest, broker.Reject} {
+		topicName := policy.String()
+
+		b.CreateTopic(topicName, broker.TopicConfig{MaxBacklog: 2, Overflow: policy})
+		b.Subscribe(topicName, "sub1")
+
+		b.Publish(topicName, newMessage("msg1"))
+		b.Publish(topicName, newMessage("msg2"))
+
+		err := b.Publish(topicName, newMessage("msg3"))
+
+		switch policy {
+		case broker.DropOldest:
+			expectError(t, "Publish drop_oldest", err, nil)
+			expectMessage(t, b, topicName, "sub1", "msg2")
+			expectMessage(t, b, topicName, "sub1", "msg3")
+		case broker.DropNewest:
+			expectError(t, "Publish drop_newest", err, nil)
+			expectMessage(t, b, topicName, "sub1", "msg1")
+			expectMessage(t, b, topicName, "sub1", "msg2")
+		case broker.Reject:
+			expectError(t, "Publish reject", err, broker.ErrQueueFull)
+			expectMessage(t, b, topicName, "sub1", "msg1")
+			expectMessage(t, b, topicName, "sub1", "msg2")
+		}
+
+		_, err = b.Get(topicName, "sub1")
+		expectError(t, "Get "+topicName, err, broker.ErrNoNewMessages)
+	}
+}
+
+// messages past their retention are not delivered
+func testRetention(t *testing.T, b broker.Broker[string]) {
+	b.CreateTopic("topic", broker.TopicConfig{Retention: time.Millisecond * 10})
+	b.Subscribe("topic", "sub1")
+	b.Publish("topic", newMessage("msg"))
+
+	<-time.After(time.Millisecond * 30)
+
+	_, err := b.Get("topic", "sub1")
+	expectError(t, "Get expired message", err, broker.ErrNoNewMessages)
+}
+
+// idle topics are deleted
+func testTopicTTL(t *testing.T, b broker.Broker[string]) {
+	b.CreateTopic("topic", broker.TopicConfig{TTL: time.Millisecond * 10})
+
+	<-time.After(time.Millisecond * 30)
+
+	_, err := b.GetTopicConfig("topic")
+	expectError(t, "GetTopicConfig expired topic", err, broker.ErrTopicNotFound)
+
+	// an expired topic is created again with its own settings only if it allows it
+	b.CreateTopic("kept", broker.TopicConfig{MaxBacklog: 3, TTL: time.Millisecond * 10, AutoCreate: true})
+	b.CreateTopic("gone", broker.TopicConfig{MaxBacklog: 3, TTL: time.Millisecond * 10})
+
+	<-time.After(time.Millisecond * 30)
+
+	expectError(t, "Subscribe expired topic", b.Subscribe("gone", "sub1"), broker.ErrTopicNotFound)
+	expectError(t, "Publish expired topic", b.Publish("gone", newMessage("msg")), broker.ErrTopicNotFound)
+	expectError(t, "Subscribe expired auto created topic", b.Subscribe("kept", "sub1"), nil)
+
+	if config, err := b.GetTopicConfig("kept"); err != nil || config.MaxBacklog != 3 || !config.AutoCreate {
+		t.Errorf("expired topic not created again with its settings: %+v, %v", config, err)
+	}
+
+	// once deleted it is forgotten
+	b.DeleteTopic("kept")
+	b.Subscribe("kept", "sub1")
+
+	if config, _ := b.GetTopicConfig("kept"); config.MaxBacklog == 3 {
+		t.Errorf("deleted topic created again with its settings")
+	}
+}
+
+// messages of concurrent publishers are all delivered, in order for each publisher
+func testConcurrentPublish(t *testing.T, b broker.Broker[string]) {
+	const publishers, messages = 4, 25
+
+	b.CreateTopic("topic", broker.TopicConfig{MaxBacklog: publishers * messages})
+	b.Subscribe("topic", "sub1")
+
+	var wg sync.WaitGroup
+
+	for p := 0; p < publishers; p++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < messages; i++ {
+				if err := b.Publish("topic", newMessage(fmt.Sprintf("%d:%d", p, i))); err != nil {
+					t.Errorf("Publish: %v", err)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	next := make([]int, publishers)
+
+	for n := 0; n < publishers*messages; n++ {
+		msg, err := b.Get("topic", "sub1")
+
+		if err != nil {
+			t.Fatalf("Get: expected %d messages, got %d: %v", publishers*messages, n, err)
+		}
+
+		var p, i int
+		fmt.Sscanf(msg.Message, "%d:%d", &p, &i)
+
+		if i != next[p] {
+			t.Errorf("publisher %d: expected message %d, got %d", p, next[p], i)
+		}
+
+		next[p] = i + 1
+	}
+}
+
+// a batch is published and pulled in order, all or none with the Reject policy
+func testBatch(t *testing.T, b broker.Broker[string]) {
+	b.Subscribe("topic", "sub1")
+
+	expectError(t, "PublishBatch empty", b.PublishBatch("topic", nil), nil)
+	expectError(t, "PublishBatch", b.PublishBatch("topic", []*broker.PubMessage{
+		newMessage("msg1"), newMessage("msg2"), newMessage("msg3"),
+	}), nil)
+
+	msgs, err := b.GetN("topic", "sub1", 2)
+
+	if err != nil || len(msgs) != 2 || msgs[0].Message != "msg1" || msgs[1].Message != "msg2" {
+		t.Errorf("GetN: expected msg1 and msg2, got %v, %v", msgs, err)
+	}
+
+	msgs, err = b.GetN("topic", "sub1", 10)
+
+	if err != nil || len(msgs) != 1 || msgs[0].Message != "msg3" {
+		t.Errorf("GetN: expected msg3, got %v, %v", msgs, err)
+	}
+
+	_, err = b.GetN("topic", "sub1", 10)
+	expectError(t, "GetN empty", err, broker.ErrNoNewMessages)
+
+	_, err = b.GetN("topic", "sub1", 0)
+	expectError(t, "GetN zero", err, broker.ErrInvalidBatch)
+
+	_, err = b.GetN("topic", "sub2", 1)
+	expectError(t, "GetN unknown subscriber", err, broker.ErrSubNotFound)
+
+	b.CreateTopic("small", broker.TopicConfig{MaxBacklog: 2, Overflow: broker.Reject})
+	b.Subscribe("small", "sub1")
+
+	err = b.PublishBatch("small", []*broker.PubMessage{newMessage("msg1"), newMessage("msg2"), newMessage("msg3")})
+	expectError(t, "PublishBatch too large", err, broker.ErrQueueFull)
+
+	_, err = b.Get("small", "sub1")
+	expectError(t, "Get after rejected batch", err, broker.ErrNoNewMessages)
+
+	expectError(t, "PublishBatch fitting", b.PublishBatch("small", []*broker.PubMessage{newMessage("msg1"), newMessage("msg2")}), nil)
+	expectMessage(t, b, "small", "sub1", "msg1")
+}
+
+// the messages of an atomic publish land on all their topics or on none
+func testPublishAtomic(t *testing.T, b broker.Broker[string]) {
+	topics := []string{"orders", "audit", "billing", "shipping", "stock", "invoices"}
+
+	for _, topicName := range topics {
+		b.Subscribe(topicName, "sub1")
+	}
+
+	b.CreateTopic("small", broker.TopicConfig{MaxBacklog: 1, Overflow: broker.Reject})
+	b.Subscribe("small", "sub1")
+
+	batches := make(map[string][]*broker.PubMessage)
+
+	for _, topicName := range topics {
+		batches[topicName] = []*broker.PubMessage{newMessage(topicName + "1"), newMessage(topicName + "2")}
+	}
+
+	expectError(t, "PublishAtomic", b.PublishAtomic(batches), nil)
+
+	for _, topicName := range topics {
+		expectMessage(t, b, topicName, "sub1", topicName+"1")
+		expectMessage(t, b, topicName, "sub1", topicName+"2")
+	}
+
+	// a topic without room fails the whole publish
+	batches["small"] = []*broker.PubMessage{newMessage("small1"), newMessage("small2")}
+	expectError(t, "PublishAtomic too large", b.PublishAtomic(batches), broker.ErrQueueFull)
+
+	for _, topicName := range append(topics, "small") {
+		_, err := b.Get(topicName, "sub1")
+		expectError(t, "Get after failed PublishAtomic", err, broker.ErrNoNewMessages)
+	}
+
+	// so does a full topic dropping the new messages, instead of losing its part
+	delete(batches, "small")
+	b.CreateTopic("full", broker.TopicConfig{MaxBacklog: 1, Overflow: broker.DropNewest})
+	b.Subscribe("full", "sub1")
+	b.Publish("full", newMessage("old"))
+
+	batches["full"] = []*broker.PubMessage{newMessage("new")}
+	expectError(t, "PublishAtomic to a full topic", b.PublishAtomic(batches), broker.ErrQueueFull)
+
+	for _, topicName := range topics {
+		_, err := b.Get(topicName, "sub1")
+		expectError(t, "Get after failed PublishAtomic", err, broker.ErrNoNewMessages)
+	}
+
+	expectMessage(t, b, "full", "sub1", "old")
+
+	// concurrent readers see all the messages of a publish or none of them
+	delete(batches, "full")
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 20; i++ {
+			if err := b.PublishAtomic(batches); err != nil {
+				t.Errorf("PublishAtomic: %v", err)
+			}
+		}
+
+		close(done)
+	}()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				// a deadlocked transaction would block these forever
+				b.ListTopics()
+				b.Publish(topics[i], newMessage("other"))
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func newKeyedMessage(msg, key string) *broker.PubMessage {
+	return &broker.PubMessage{Message: msg, Published: time.Now(), Key: key}
+}
+
+// messages sharing a key wait for the previous one to be acked, the other keys proceed
+func testOrderingKeys(t *testing.T, b broker.Broker[string]) {
+	b.Subscribe("topic", "sub1")
+
+	for _, msg := range []*broker.PubMessage{
+		newKeyedMessage("a1", "a"), newKeyedMessage("a2", "a"), newKeyedMessage("b1", "b"),
+		newMessage("plain"), newKeyedMessage("a3", "a"), newKeyedMessage("b2", "b"),
+	} {
+		b.Publish("topic", msg)
+	}
+
+	msgs, err := b.GetN("topic", "sub1", 10)
+
+	if err != nil || len(msgs) != 3 || msgs[0].Message != "a1" || msgs[1].Message != "b1" || msgs[2].Message != "plain" {
+		t.Fatalf("GetN: expected a1, b1 and plain, got %v, %v", msgs, err)
+	}
+
+	if msgs[0].ID == msgs[1].ID || msgs[0].ID == 0 {
+		t.Errorf("messages without a unique id: %d, %d", msgs[0].ID, msgs[1].ID)
+	}
+
+	expectError(t, "Ack unkeyed", b.Ack("topic", "sub1", msgs[2].ID), broker.ErrMessageNotFound)
+	expectError(t, "Ack unknown subscriber", b.Ack("topic", "sub2", msgs[0].ID), broker.ErrSubNotFound)
+
+	// acking a1 releases a2, which is older than the messages left in the log
+	expectError(t, "Ack a1", b.Ack("topic", "sub1", msgs[0].ID), nil)
+	expectError(t, "Ack a1 twice", b.Ack("topic", "sub1", msgs[0].ID), broker.ErrMessageNotFound)
+
+	a2, _ := b.Get("topic", "sub1")
+
+	if a2 == nil || a2.Message != "a2" {
+		t.Fatalf("Get: expected a2, got %v", a2)
+	}
+
+	_, err = b.Get("topic", "sub1")
+	expectError(t, "Get with all the keys in flight", err, broker.ErrNoNewMessages)
+
+	// a blocked receiver is woken up by the ack
+	received := make(chan *broker.PubMessage, 1)
+
+	go func() {
+		msg, _ := b.Receive(context.Background(), "topic", "sub1")
+		received <- msg
+	}()
+
+	<-time.After(time.Millisecond * 10)
+	b.Ack("topic", "sub1", msgs[1].ID)
+
+	select {
+	case msg := <-received:
+		if msg == nil || msg.Message != "b2" {
+			t.Errorf("Receive: expected b2, got %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Receive not woken up by Ack")
+	}
+
+	b.Ack("topic", "sub1", a2.ID)
+	expectMessage(t, b, "topic", "sub1", "a3")
+
+	// the messages held back count toward the backlog
+	b.CreateTopic("small", broker.TopicConfig{MaxBacklog: 2, Overflow: broker.Reject})
+	b.Subscribe("small", "sub1")
+
+	b.Publish("small", newKeyedMessage("k1", "k"))
+	k1, _ := b.Get("small", "sub1")
+
+	for _, msg := range []string{"k2", "k3"} {
+		expectError(t, "Publish "+msg, b.Publish("small", newKeyedMessage(msg, "k")), nil)
+	}
+
+	_, err = b.Get("small", "sub1")
+	expectError(t, "Get with the key in flight", err, broker.ErrNoNewMessages)
+	expectError(t, "Publish with a full backlog held back", b.Publish("small", newKeyedMessage("k4", "k")), broker.ErrQueueFull)
+
+	// acking k1 delivers k2, which leaves room for one message
+	b.Ack("small", "sub1", k1.ID)
+	expectError(t, "Publish after Ack", b.Publish("small", newKeyedMessage("k4", "k")), nil)
+}
+
+// a keyed message not acked in time is delivered again
+func testAckTimeout(t *testing.T, b broker.Broker[string]) {
+	b.CreateTopic("topic", broker.TopicConfig{AckTimeout: time.Millisecond * 10})
+	b.Subscribe("topic", "sub1")
+
+	b.Publish("topic", newKeyedMessage("a1", "a"))
+	b.Publish("topic", newKeyedMessage("a2", "a"))
+
+	first, _ := b.Get("topic", "sub1")
+
+	_, err := b.Get("topic", "sub1")
+	expectError(t, "Get before the ack timeout", err, broker.ErrNoNewMessages)
+
+	<-time.After(time.Millisecond * 20)
+
+	again, err := b.Get("topic", "sub1")
+
+	if err != nil || again.ID != first.ID {
+		t.Fatalf("Get: expected a1 again, got %v, %v", again, err)
+	}
+
+	b.Ack("topic", "sub1", again.ID)
+	a2, _ := b.Get("topic", "sub1")
+
+	if a2 == nil || a2.Message != "a2" {
+		t.Fatalf("Get: expected a2, got %v", a2)
+	}
+
+	// a held message requeued by the ack is delivered once, even past its ack deadline
+	b.Publish("topic", newKeyedMessage("a3", "a"))
+
+	_, err = b.Get("topic", "sub1")
+	expectError(t, "Get with the key in flight", err, broker.ErrNoNewMessages)
+
+	b.Ack("topic", "sub1", a2.ID)
+
+	<-time.After(time.Millisecond * 20)
+
+	expectMessage(t, b, "topic", "sub1", "a3")
+
+	_, err = b.Get("topic", "sub1")
+	expectError(t, "Get after the requeued message", err, broker.ErrNoNewMessages)
+}
+
+func newPriorityMessage(msg string, priority int) *broker.PubMessage {
+	return &broker.PubMessage{Message: msg, Published: time.Now(), Priority: priority}
+}
+
+// the highest priority is delivered first, in publish order within a priority
+func testPriorities(t *testing.T, b broker.Broker[string]) {
+	b.Subscribe("topic", "sub1")
+
+	for _, msg := range []*broker.PubMessage{
+		newPriorityMessage("low1", 0), newPriorityMessage("high1", broker.MAX_PRIORITY),
+		newPriorityMessage("mid1", 5), newPriorityMessage("low2", 0), newPriorityMessage("high2", broker.MAX_PRIORITY),
+	} {
+		expectError(t, "Publish", b.Publish("topic", msg), nil)
+	}
+
+	for _, want := range []string{"high1", "high2", "mid1", "low1", "low2"} {
+		expectMessage(t, b, "topic", "sub1", want)
+	}
+
+	expectError(t, "Publish negative priority", b.Publish("topic", newPriorityMessage("bad", -1)), broker.ErrInvalidPriority)
+	expectError(t, "Publish priority too high", b.Publish("topic", newPriorityMessage("bad", broker.MAX_PRIORITY+1)),
+		broker.ErrInvalidPriority)
+	expectError(t, "PublishBatch invalid priority", b.PublishBatch("topic", []*broker.PubMessage{
+		newPriorityMessage("ok", 1), newPriorityMessage("bad", broker.MAX_PRIORITY+1),
+	}), broker.ErrInvalidPriority)
+
+	_, err := b.Get("topic", "sub1")
+	expectError(t, "Get after invalid publishes", err, broker.ErrNoNewMessages)
+}
+
+// the backlog and the overflow policy apply to the messages of all the priorities
+func testPriorityBacklog(t *testing.T, b broker.Broker[string]) {
+	for _, policy := range []broker.OverflowPolicy{broker.DropOldest, broker.DropNewest, broker.Reject} {
+		topicName := policy.String()
+
+		b.CreateTopic(topicName, broker.TopicConfig{MaxBacklog: 2, Overflow: policy})
+		b.Subscribe(topicName, "sub1")
+
+		b.Publish(topicName, newPriorityMessage("low", 0))
+		b.Publish(topicName, newPriorityMessage("mid", 5))
+
+		err := b.Publish(topicName, newPriorityMessage("high", broker.MAX_PRIORITY))
+
+		switch policy {
+		case broker.DropOldest:
+			expectError(t, "Publish drop_oldest", err, nil)
+			expectMessage(t, b, topicName, "sub1", "high")
+			expectMessage(t, b, topicName, "sub1", "mid")
+		case broker.DropNewest:
+			expectError(t, "Publish drop_newest", err, nil)
+			expectMessage(t, b, topicName, "sub1", "mid")
+			expectMessage(t, b, topicName, "sub1", "low")
+		case broker.Reject:
+			expectError(t, "Publish reject", err, broker.ErrQueueFull)
+			expectError(t, "PublishBatch reject", b.PublishBatch(topicName, []*broker.PubMessage{
+				newPriorityMessage("high", broker.MAX_PRIORITY),
+			}), broker.ErrQueueFull)
+			expectMessage(t, b, topicName, "sub1", "mid")
+			expectMessage(t, b, topicName, "sub1", "low")
+		}
+
+		_, err = b.Get(topicName, "sub1")
+		expectError(t, "Get "+topicName, err, broker.ErrNoNewMessages)
+	}
+}
+
+// a low priority message is delivered even while higher priority ones keep coming
+func testPriorityStarvation(t *testing.T, b broker.Broker[string]) {
+	b.Subscribe("topic", "sub1")
+	b.Publish("topic", newPriorityMessage("low", 0))
+
+	const HIGH = 15
+
+	for i := 0; i < HIGH; i++ {
+		b.Publish("topic", newPriorityMessage("high", broker.MAX_PRIORITY))
+	}
+
+	for i := 0; i < HIGH; i++ {
+		msg, err := b.Get("topic", "sub1")
+
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+
+		if msg.Message == "low" {
+			return
+		}
+	}
+
+	t.Errorf("low priority message starved by %d high priority ones", HIGH)
+}
+
+// a publish with an idempotency key seen within the dedup window is dropped
+func testDedup(t *testing.T, b broker.Broker[string]) {
+	b.CreateTopic("topic", broker.TopicConfig{DedupWindow: time.Millisecond * 50})
+	b.Subscribe("topic", "sub1")
+
+	first := &broker.PubMessage{Message: "msg1", Published: time.Now(), IdempotencyKey: "k1"}
+	expectError(t, "Publish", b.Publish("topic", first), nil)
+
+	retry := &broker.PubMessage{Message: "msg1", Published: time.Now(), IdempotencyKey: "k1"}
+	expectError(t, "Publish retry", b.Publish("topic", retry), nil)
+
+	if retry.ID != first.ID {
+		t.Errorf("retry: expected the id of the original %d, got %d", first.ID, retry.ID)
+	}
+
+	b.PublishBatch("topic", []*broker.PubMessage{
+		{Message: "msg1", Published: time.Now(), IdempotencyKey: "k1"},
+		{Message: "msg2", Published: time.Now(), IdempotencyKey: "k2"},
+	})
+
+	expectMessage(t, b, "topic", "sub1", "msg1")
+	expectMessage(t, b, "topic", "sub1", "msg2")
+
+	_, err := b.Get("topic", "sub1")
+	expectError(t, "Get after the duplicates", err, broker.ErrNoNewMessages)
+
+	config, _ := b.GetTopicConfig("topic")
+
+	if config.DedupWindow != time.Millisecond*50 {
+		t.Errorf("expected a dedup window of 50ms, got %v", config.DedupWindow)
+	}
+
+	// once the window is over the key is accepted again
+	<-time.After(time.Millisecond * 60)
+
+	b.Publish("topic", &broker.PubMessage{Message: "msg3", Published: time.Now(), IdempotencyKey: "k1"})
+	expectMessage(t, b, "topic", "sub1", "msg3")
+
+	// a topic without deduplication keeps every publish
+	expectError(t, "SetTopicConfig", b.SetTopicConfig("topic", broker.TopicConfig{DedupWindow: broker.NO_DEDUP}), nil)
+
+	for _, msg := range []string{"msg4", "msg5"} {
+		b.Publish("topic", &broker.PubMessage{Message: msg, Published: time.Now(), IdempotencyKey: "k4"})
+	}
+
+	expectMessage(t, b, "topic", "sub1", "msg4")
+	expectMessage(t, b, "topic", "sub1", "msg5")
+
+	if config, _ := b.GetTopicConfig("topic"); config.DedupWindow != broker.NO_DEDUP {
+		t.Errorf("expected no dedup window, got %v", config.DedupWindow)
+	}
+}
+
+// Request waits for the reply with its correlation id, the reply topic is gone afterwards
+func testRequestReply(t *testing.T, b broker.Broker[string]) {
+	b.Subscribe("rpc", "server")
+
+	go func() {
+		req, err := b.Receive(context.Background(), "rpc", "server")
+
+		if err != nil {
+			return
+		}
+
+		b.Publish(req.ReplyTo, &broker.PubMessage{Message: "stray", Published: time.Now(), CorrelationID: "other"})
+		b.Publish(req.ReplyTo, &broker.PubMessage{Message: "pong", Published: time.Now(), CorrelationID: req.CorrelationID})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	msg := newMessage("ping")
+	reply, err := b.Request(ctx, "rpc", msg)
+
+	if err != nil || reply.Message != "pong" || reply.CorrelationID != msg.CorrelationID || msg.CorrelationID == "" {
+		t.Fatalf("Request: expected pong for %q, got %v, %v", msg.CorrelationID, reply, err)
+	}
+
+	expectError(t, "reply after the request", b.Publish(msg.ReplyTo, newMessage("late")), broker.ErrTopicNotFound)
+
+	// without a responder the request times out
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+
+	msg = &broker.PubMessage{Message: "ping", Published: time.Now(), CorrelationID: "mine"}
+	_, err = b.Request(ctx, "nobody", msg)
+	expectError(t, "Request without a responder", err, context.DeadlineExceeded)
+
+	if msg.CorrelationID != "mine" {
+		t.Errorf("Request replaced the correlation id with %q", msg.CorrelationID)
+	}
+
+	expectError(t, "late reply", b.Publish(msg.ReplyTo, newMessage("late")), broker.ErrTopicNotFound)
+}
+
+// the forwarding rules copy the messages along, filtered and transformed, without loops
+func testForwarding(t *testing.T, b broker.Broker[string]) {
+	b.Subscribe("orders.eu", "sub1")
+	b.Subscribe("orders.all", "sub1")
+	b.Subscribe("audit", "sub1")
+
+	expectError(t, "SetForwardingRule", b.SetForwardingRule("eu", broker.ForwardingRule[string]{
+		Source:      "orders.eu",
+		Destination: "orders.all",
+		Filter:      func(msg *broker.PubMessage) bool { return msg.Key != "internal" },
+		Transform:   func(msg *broker.PubMessage) { msg.Message = "eu:" + msg.Message },
+	}), nil)
+	expectError(t, "SetForwardingRule chained", b.SetForwardingRule("audit", broker.ForwardingRule[string]{
+		Source: "orders.all", Destination: "audit",
+	}), nil)
+
+	expectError(t, "SetForwardingRule closing a loop", b.SetForwardingRule("back", broker.ForwardingRule[string]{
+		Source: "audit", Destination: "orders.eu",
+	}), broker.ErrForwardingLoop)
+	expectError(t, "SetForwardingRule to its source", b.SetForwardingRule("self", broker.ForwardingRule[string]{
+		Source: "audit", Destination: "audit",
+	}), broker.ErrForwardingLoop)
+	expectError(t, "SetForwardingRule without a source", b.SetForwardingRule("bad", broker.ForwardingRule[string]{
+		Destination: "audit",
+	}), broker.ErrInvalidRule)
+	expectError(t, "DeleteForwardingRule unknown", b.DeleteForwardingRule("bad"), broker.ErrRuleNotFound)
+
+	rules, err := b.ForwardingRules()
+
+	if err != nil || len(rules) != 2 || rules["eu"].Destination != "orders.all" {
+		t.Errorf("ForwardingRules: expected eu and audit, got %v, %v", rules, err)
+	}
+
+	msg := newMessage("order1")
+	b.Publish("orders.eu", msg)
+	b.Publish("orders.eu", newKeyedMessage("secret", "internal"))
+	b.PublishBatch("orders.eu", []*broker.PubMessage{newMessage("order2")})
+
+	source, _ := b.Get("orders.eu", "sub1")
+
+	if source == nil || source.Message != "order1" || source.ID != msg.ID {
+		t.Errorf("Get: expected the original order1, got %v", source)
+	}
+
+	for _, topicName := range []string{"orders.all", "audit"} {
+		expectMessage(t, b, topicName, "sub1", "eu:order1")
+		expectMessage(t, b, topicName, "sub1", "eu:order2")
+
+		_, err = b.Get(topicName, "sub1")
+		expectError(t, "Get filtered message", err, broker.ErrNoNewMessages)
+	}
+
+	expectError(t, "DeleteForwardingRule", b.DeleteForwardingRule("eu"), nil)
+	b.Publish("orders.eu", newMessage("order3"))
+
+	_, err = b.Get("orders.all", "sub1")
+	expectError(t, "Get after deleting the rule", err, broker.ErrNoNewMessages)
+
+	// a message reaching a topic by two paths is published to it once
+	for name, rule := range map[string][2]string{"ab": {"a", "b"}, "ac": {"a", "c"}, "bd": {"b", "d"}, "cd": {"c", "d"}} {
+		b.SetForwardingRule(name, broker.ForwardingRule[string]{Source: rule[0], Destination: rule[1]})
+	}
+
+	b.Subscribe("d", "sub1")
+	b.Publish("a", newMessage("diamond"))
+
+	expectMessage(t, b, "d", "sub1", "diamond")
+
+	_, err = b.Get("d", "sub1")
+	expectError(t, "Get after a diamond", err, broker.ErrNoNewMessages)
+
+	// the idempotency keys are scoped by the source topic, a retry is still dropped
+	b.SetForwardingRule("us", broker.ForwardingRule[string]{Source: "orders.us", Destination: "orders.merged"})
+	b.SetForwardingRule("eu", broker.ForwardingRule[string]{Source: "orders.eu", Destination: "orders.merged"})
+	b.Subscribe("orders.merged", "sub1")
+
+	for _, topicName := range []string{"orders.us", "orders.eu", "orders.eu"} {
+		b.Publish(topicName, &broker.PubMessage{Message: topicName, Published: time.Now(), IdempotencyKey: "k1"})
+	}
+
+	expectMessage(t, b, "orders.merged", "sub1", "orders.us")
+	expectMessage(t, b, "orders.merged", "sub1", "orders.eu")
+
+	_, err = b.Get("orders.merged", "sub1")
+	expectError(t, "Get after a retry", err, broker.ErrNoNewMessages)
+
+	// only the messages stored by the source are forwarded, not a duplicate nor a dropped one
+	b.CreateTopic("full", broker.TopicConfig{MaxBacklog: 1, Overflow: broker.DropNewest})
+	b.CreateTopic("copy", broker.TopicConfig{DedupWindow: broker.NO_DEDUP})
+	b.SetForwardingRule("full", broker.ForwardingRule[string]{Source: "full", Destination: "copy"})
+	b.Subscribe("full", "sub1")
+	b.Subscribe("copy", "sub1")
+
+	for _, msg := range []string{"stored", "stored", "dropped"} {
+		b.Publish("full", &broker.PubMessage{Message: msg, Published: time.Now(), IdempotencyKey: msg})
+	}
+
+	expectMessage(t, b, "copy", "sub1", "stored")
+
+	_, err = b.Get("copy", "sub1")
+	expectError(t, "Get after a duplicate and a dropped message", err, broker.ErrNoNewMessages)
+}
+
+// the interceptors run in order on publish, enqueue and delivery
+func testInterceptors(t *testing.T, b broker.Broker[string]) {
+	var order []string
+
+	b.Use(broker.Interceptor[string]{
+		OnPublish: func(topicName string, msg *broker.PubMessage) error {
+			order = append(order, "first")
+
+			if msg.Message == "bad" {
+				return broker.ErrRejected
+			}
+
+			msg.Message = topicName + ":" + msg.Message
+			return nil
+		},
+		OnEnqueue: func(topicName, subscriberName string, msg *broker.PubMessage) bool {
+			return subscriberName != "sub2" || !strings.Contains(msg.Message, "secret")
+		},
+	}, broker.Interceptor[string]{
+		OnPublish: func(topicName string, msg *broker.PubMessage) error {
+			order = append(order, "second")
+			return nil
+		},
+		OnDeliver: func(topicName, subscriberName string, msg *broker.PubMessage) *broker.PubMessage {
+			out := *msg
+			out.Message += "@" + subscriberName
+			return &out
+		},
+	})
+
+	b.Subscribe("topic", "sub1")
+	b.Subscribe("topic", "sub2")
+
+	expectError(t, "Publish", b.Publish("topic", newMessage("msg1")), nil)
+
+	if len(order) != 2 || order[0] != "first" || order[1] != "second" {
+		t.Errorf("publish interceptors: expected first then second, got %v", order)
+	}
+
+	expectError(t, "Publish rejected", b.Publish("topic", newMessage("bad")), broker.ErrRejected)
+	expectError(t, "PublishBatch rejected", b.PublishBatch("topic", []*broker.PubMessage{newMessage("ok"), newMessage("bad")}),
+		broker.ErrRejected)
+	b.PublishBatch("topic", []*broker.PubMessage{newMessage("secret"), newMessage("msg2")})
+
+	expectMessage(t, b, "topic", "sub1", "topic:msg1@sub1")
+
+	msgs, err := b.GetN("topic", "sub1", 10)
+
+	if err != nil || len(msgs) != 2 || msgs[0].Message != "topic:secret@sub1" || msgs[1].Message != "topic:msg2@sub1" {
+		t.Errorf("GetN: expected the secret and msg2, got %v, %v", msgs, err)
+	}
+
+	expectMessage(t, b, "topic", "sub2", "topic:msg1@sub2")
+
+	msg, err := b.Receive(context.Background(), "topic", "sub2")
+
+	if err != nil || msg.Message != "topic:msg2@sub2" {
+		t.Errorf("Receive: expected msg2 without the secret, got %v, %v", msg, err)
+	}
+}
+
+// the Validate hooks refuse the published messages and skip the forwarded ones
+func testValidate(t *testing.T, b broker.Broker[string]) {
+	b.Use(broker.Interceptor[string]{
+		Validate: func(topicName string, msg *broker.PubMessage) error {
+			if topicName == "strict" && msg.Message == "bad" {
+				return broker.ErrRejected
+			}
+
+			return nil
+		},
+	})
+
+	b.Subscribe("strict", "sub1")
+
+	var invalid *broker.MessageError
+
+	err := b.PublishBatch("strict", []*broker.PubMessage{newMessage("ok"), newMessage("bad")})
+
+	if !errors.As(err, &invalid) || invalid.Topic != "strict" || invalid.Index != 1 || !errors.Is(err, broker.ErrRejected) {
+		t.Errorf("PublishBatch: expected the second message refused, got %v", err)
+	}
+
+	err = b.PublishAtomic(map[string][]*broker.PubMessage{"lax": {newMessage("bad")}, "strict": {newMessage("bad")}})
+
+	if !errors.Is(err, broker.ErrRejected) {
+		t.Errorf("PublishAtomic: expected the message refused, got %v", err)
+	}
+
+	b.SetForwardingRule("lax", broker.ForwardingRule[string]{Source: "lax", Destination: "strict"})
+
+	expectError(t, "Publish forwarded invalid message", b.Publish("lax", newMessage("bad")), nil)
+	expectError(t, "Publish forwarded message", b.Publish("lax", newMessage("good")), nil)
+
+	expectMessage(t, b, "strict", "sub1", "good")
+
+	_, err = b.Get("strict", "sub1")
+	expectError(t, "Get after the invalid messages", err, broker.ErrNoNewMessages)
+}
+
+// Receive blocks until a message is published
+func testReceive(t *testing.T, b broker.Broker[string]) {
+	b.Subscribe("topic", "sub1")
+
+	_, err := b.Receive(context.Background(), "missing", "sub1")
+	expectError(t, "Receive unknown topic", err, broker.ErrTopicNotFound)
+
+	_, err = b.Receive(context.Background(), "topic", "sub2")
+	expectError(t, "Receive unknown subscriber", err, broker.ErrSubNotFound)
+
+	// a pending message is returned right away
+	b.Publish("topic", newMessage("msg1"))
+
+	if msg, err := b.Receive(context.Background(), "topic", "sub1"); err != nil || msg.Message != "msg1" {
+		t.Errorf("Receive: expected message msg1, got %v, %v", msg, err)
+	}
+
+	received := make(chan *broker.PubMessage)
+
+	go func() {
+		msg, err := b.Receive(context.Background(), "topic", "sub1")
+
+		if err != nil {
+			t.Errorf("Receive: %v", err)
+		}
+
+		received <- msg
+	}()
+
+	select {
+	case <-received:
+		t.Fatalf("Receive returned before a message was published")
+	case <-time.After(time.Millisecond * 10):
+	}
+
+	b.Publish("topic", newMessage("msg2"))
+
+	select {
+	case msg := <-received:
+		if msg == nil || msg.Message != "msg2" {
+			t.Errorf("Receive: expected message msg2, got %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Receive not woken up by Publish")
+	}
+}
+
+// a cancelled Receive returns the context error and does not consume a message
+func testReceiveCancel(t *testing.T, b broker.Broker[string]) {
+	b.Subscribe("topic", "sub1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+
+	_, err := b.Receive(ctx, "topic", "sub1")
+	expectError(t, "Receive timeout", err, context.DeadlineExceeded)
+
+	b.Publish("topic", newMessage("msg"))
+	expectMessage(t, b, "topic", "sub1", "msg")
+}
+
+// a blocked Receive fails once its subscriber or topic is removed
+func testReceiveUnblock(t *testing.T, b broker.Broker[string]) {
+	b.Subscribe("topic", "sub1")
+	b.Subscribe("topic", "sub2")
+
+	errs := make(chan error, 2)
+
+	for _, sub := range []string{"sub1", "sub2"} {
+		go func() {
+			_, err := b.Receive(context.Background(), "topic", sub)
+			errs <- err
+		}()
+	}
+
+	<-time.After(time.Millisecond * 10)
+
+	b.UnSubscribe("topic", "sub1")
+	expectError(t, "Receive after UnSubscribe", <-errs, broker.ErrSubNotFound)
+
+	b.DeleteTopic("topic")
+	expectError(t, "Receive after DeleteTopic", <-errs, broker.ErrTopicNotFound)
+}
+
+// Messages streams the published messages until ctx is done
+func testMessages(t *testing.T, b broker.Broker[string]) {
+	b.Subscribe("topic", "sub1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := b.Messages(ctx, "topic", "sub1")
+
+	for i := 0; i < 3; i++ {
+		b.Publish("topic", newMessage(fmt.Sprintf("msg%d", i)))
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-ch:
+			if msg == nil || msg.Message != fmt.Sprintf("msg%d", i) {
+				t.Errorf("Messages: expected message msg%d, got %v", i, msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Messages: message msg%d not delivered", i)
+		}
+	}
+
+	cancel()
+
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Errorf("Messages: message delivered after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Messages: channel not closed after cancel")
+	}
+
+	// a message received but not read when ctx is done is given back, its key is released
+	b.Subscribe("topic", "sub2")
+
+	ctx, cancel = context.WithCancel(context.Background())
+	ch = b.Messages(ctx, "topic", "sub2")
+
+	b.Publish("topic", newKeyedMessage("unread", "k1"))
+	<-time.After(time.Millisecond * 10)
+	cancel()
+
+	rctx, rcancel := context.WithTimeout(context.Background(), time.Second)
+	defer rcancel()
+
+	if msg, err := b.Receive(rctx, "topic", "sub2"); err != nil || msg.Message != "unread" {
+		t.Errorf("Messages: message unread on cancel lost: %v", err)
+	}
+
+	for range ch {
+	}
+}
+
+// wait for a condition, polling it
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		<-time.After(time.Millisecond)
+	}
+}
+
+// Consume pushes every message to the handlers, concurrently
+func testConsume(t *testing.T, b broker.Broker[string]) {
+	b.CreateTopic("topic", broker.TopicConfig{MaxBacklog: 100})
+	b.Subscribe("topic", "sub1")
+
+	if _, err := b.Consume("topic", "sub1", nil, broker.ConsumeOptions{}); err != broker.ErrInvalidConsumeOptions {
+		t.Errorf("Consume: nil handler not flagged")
+	}
+
+	var mu sync.Mutex
+	var active, maxActive int
+	received := make(map[string]bool)
+
+	c, err := b.Consume("topic", "sub1", func(ctx context.Context, msg *broker.PubMessage) error {
+		mu.Lock()
+		active++
+		maxActive = max(maxActive, active)
+		mu.Unlock()
+
+		<-time.After(time.Millisecond)
+
+		mu.Lock()
+		active--
+		received[msg.Message] = true
+		mu.Unlock()
+
+		return nil
+	}, broker.ConsumeOptions{Concurrency: 4})
+
+	if err != nil {
+		t.Fatalf("Consume: %v", err)
+	}
+
+	for i := 0; i < 50; i++ {
+		b.Publish("topic", newMessage(fmt.Sprintf("msg%d", i)))
+	}
+
+	eventually(t, "all the messages to be handled", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 50
+	})
+
+	expectError(t, "Stop", c.Stop(context.Background()), nil)
+	expectError(t, "Err after Stop", c.Err(), nil)
+
+	if maxActive < 2 || maxActive > 4 {
+		t.Errorf("Consume: expected up to 4 concurrent handlers, got %d", maxActive)
+	}
+
+	// a consumer of a missing subscriber stops on its own
+	c, _ = b.Consume("topic", "missing", func(ctx context.Context, msg *broker.PubMessage) error {
+		return nil
+	}, broker.ConsumeOptions{})
+
+	select {
+	case <-c.Done():
+		expectError(t, "Err", c.Err(), broker.ErrSubNotFound)
+	case <-time.After(time.Second):
+		t.Errorf("Consume: consumer of a missing subscriber still running")
+	}
+}
+
+// a failing or panicking handler gets the message again, up to MaxAttempts
+func testConsumeRetry(t *testing.T, b broker.Broker[string]) {
+	b.Subscribe("topic", "sub1")
+
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	var dropped []string
+
+	c, _ := b.Consume("topic", "sub1", func(ctx context.Context, msg *broker.PubMessage) error {
+		mu.Lock()
+		calls[msg.Message]++
+		n := calls[msg.Message]
+		mu.Unlock()
+
+		switch {
+		case msg.Message == "poison":
+			return fmt.Errorf("cannot handle %s", msg.Message)
+		case msg.Message == "panic" && n == 1:
+			panic("handler bug")
+		case msg.Message == "flaky" && n < 3:
+			return fmt.Errorf("try again")
+		}
+
+		return nil
+	}, broker.ConsumeOptions{MaxAttempts: 3, OnError: func(err error, attempt int, isDropped bool) {
+		if isDropped {
+			mu.Lock()
+			dropped = append(dropped, err.Error())
+			mu.Unlock()
+		}
+	}})
+
+	for _, msg := range []string{"poison", "panic", "flaky", "ok"} {
+		b.Publish("topic", newMessage(msg))
+	}
+
+	eventually(t, "the messages to be handled", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls["ok"] == 1 && calls["flaky"] == 3 && calls["panic"] == 2 && len(dropped) == 1
+	})
+
+	c.Stop(context.Background())
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if calls["poison"] != 3 || dropped[0] != "cannot handle poison" {
+		t.Errorf("Consume: poison message handled %d times, dropped %v", calls["poison"], dropped)
+	}
+}
+
+// Stop waits for the handlers in flight, the consumer stops on its own when the topic goes away
+func testConsumeStop(t *testing.T, b broker.Broker[string]) {
+	b.Subscribe("topic", "sub1")
+
+	started := make(chan struct{})
+	finished := make(chan struct{})
+
+	c, _ := b.Consume("topic", "sub1", func(ctx context.Context, msg *broker.PubMessage) error {
+		close(started)
+		<-time.After(time.Millisecond * 20)
+		close(finished)
+		return nil
+	}, broker.ConsumeOptions{})
+
+	b.Publish("topic", newMessage("msg"))
+	<-started
+
+	expectError(t, "Stop", c.Stop(context.Background()), nil)
+
+	select {
+	case <-finished:
+	default:
+		t.Errorf("Stop returned before the handler in flight")
+	}
+
+	// a Stop timing out cancels the context of the handlers
+	c, _ = b.Consume("topic", "sub1", func(ctx context.Context, msg *broker.PubMessage) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, broker.ConsumeOptions{})
+
+	b.Publish("topic", newMessage("slow"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+
+	<-time.After(time.Millisecond * 5)
+	expectError(t, "Stop timeout", c.Stop(ctx), context.DeadlineExceeded)
+
+	// the message the handler failed on is retried by the next consumer
+	expectMessage(t, b, "topic", "sub1", "slow")
+
+	c, _ = b.Consume("topic", "sub1", func(ctx context.Context, msg *broker.PubMessage) error {
+		return nil
+	}, broker.ConsumeOptions{})
+
+	b.DeleteTopic("topic")
+
+	select {
+	case <-c.Done():
+		expectError(t, "Err", c.Err(), broker.ErrTopicNotFound)
+	case <-time.After(time.Second):
+		t.Errorf("Consume: consumer of a deleted topic still running")
+	}
+}
+
+// concurrent handlers never process two messages with the same key at once, nor out of order
+func testConsumeOrdering(t *testing.T, b broker.Broker[string]) {
+	const keys, messages = 4, 10
+
+	b.CreateTopic("topic", broker.TopicConfig{MaxBacklog: keys * messages})
+	b.Subscribe("topic", "sub1")
+
+	var mu sync.Mutex
+	active := make(map[string]bool)
+	next := make(map[string]int)
+	handled := 0
+	failed := make(map[string]bool)
+
+	c, _ := b.Consume("topic", "sub1", func(ctx context.Context, msg *broker.PubMessage) error {
+		mu.Lock()
+
+		if active[msg.Key] {
+			t.Errorf("Consume: two messages with key %s handled at once", msg.Key)
+		}
+
+		active[msg.Key] = true
+		mu.Unlock()
+
+		<-time.After(time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		active[msg.Key] = false
+
+		// fail once per key, the message is retried before the next one with its key
+		if !failed[msg.Key] {
+			failed[msg.Key] = true
+			return fmt.Errorf("try again")
+		}
+
+		var i int
+		fmt.Sscanf(msg.Message, "%d", &i)
+
+		if i != next[msg.Key] {
+			t.Errorf("Consume: key %s expected message %d, got %d", msg.Key, next[msg.Key], i)
+		}
+
+		next[msg.Key] = i + 1
+		handled++
+
+		return nil
+	}, broker.ConsumeOptions{Concurrency: keys * 2})
+
+	for i := 0; i < messages; i++ {
+		for k := 0; k < keys; k++ {
+			b.Publish("topic", newKeyedMessage(fmt.Sprint(i), fmt.Sprintf("key%d", k)))
+		}
+	}
+
+	eventually(t, "the keyed messages to be handled", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return handled == keys*messages
+	})
+
+	c.Stop(context.Background())
+}
+
+// Ping answers while the broker serves requests, a cancelled context makes it fail
+func testPing(t *testing.T, b broker.Broker[string]) {
+	b.Subscribe("topic", "sub1")
+	b.Publish("topic", newMessage("msg"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	expectError(t, "Ping", b.Ping(ctx), nil)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+
+	if err := b.Ping(ctx); err != nil && err != context.Canceled {
+		t.Errorf("Ping: expected nil or context.Canceled, got %v", err)
+	}
+
+	expectMessage(t, b, "topic", "sub1", "msg")
+}
+
+// a closed broker refuses every request, Close can be called again
+func testClose(t *testing.T, b broker.Broker[string]) {
+	b.Subscribe("topic", "sub1")
+
+	// a blocked Receive is released by Close
+	blocked := make(chan error, 1)
+
+	go func() {
+		_, err := b.Receive(context.Background(), "topic", "sub1")
+		blocked <- err
+	}()
+
+	<-time.After(time.Millisecond * 10)
+
+	expectError(t, "Close", b.Close(context.Background()), nil)
+	expectError(t, "blocked Receive", <-blocked, broker.ErrClosed)
+	expectError(t, "Close twice", b.Close(context.Background()), nil)
+
+	expectError(t, "Subscribe", b.Subscribe("topic", "sub2"), broker.ErrClosed)
+	expectError(t, "UnSubscribe", b.UnSubscribe("topic", "sub1"), broker.ErrClosed)
+	expectError(t, "Publish", b.Publish("topic", newMessage("msg")), broker.ErrClosed)
+	expectError(t, "CreateTopic", b.CreateTopic("other", broker.TopicConfig{}), broker.ErrClosed)
+	expectError(t, "DeleteTopic", b.DeleteTopic("topic"), broker.ErrClosed)
+
+	_, err := b.Get("topic", "sub1")
+	expectError(t, "Get", err, broker.ErrClosed)
+
+	_, err = b.Receive(context.Background(), "topic", "sub1")
+	expectError(t, "Receive", err, broker.ErrClosed)
+
+	if _, ok := <-b.Messages(context.Background(), "topic", "sub1"); ok {
+		t.Errorf("Messages: message delivered after Close")
+	}
+
+	_, err = b.ListTopics()
+	expectError(t, "ListTopics", err, broker.ErrClosed)
+
+	_, err = b.GetTopicConfig("topic")
+	expectError(t, "GetTopicConfig", err, broker.ErrClosed)
+
+	expectError(t, "SetTopicConfig", b.SetTopicConfig("topic", broker.TopicConfig{}), broker.ErrClosed)
+
+	expectError(t, "Ping", b.Ping(context.Background()), broker.ErrClosed)
+}
@@ -0,0 +1,139 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   This file contains the interceptors, hooks run on the messages going through a broker
+   for auditing, enrichment or redaction, along with the built-in ones.
+
+   pb.Use(broker.Timestamp[string](time.Now), broker.RedactJSON("password"))
+
+*/
+
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// hooks run on the messages going through a broker, the nil ones are skipped. The
+// interceptors added with Use run in the order they were added.
+type Interceptor[T any] struct {
+	// called on publish before the message is stored, it may modify the message. An error
+	// (ErrRejected or another one) rejects the publish, the whole batch, and is returned to the publisher.
+	// The messages forwarded by the forwarding rules do not go through it again.
+	OnPublish func(topicName string, msg *Message[T]) error
+	// called on every message about to be stored in a topic after OnPublish, the forwarded
+	// ones included. An error rejects the publish (as a *MessageError) or skips the forwarded
+	// message. The message must not be modified.
+	Validate func(topicName string, msg *Message[T]) error
+	// called once a message is stored in a topic, the forwarded ones included: it is then queued
+	// for the subscribers. It runs on the event loop and must not block, the message must not be modified.
+	OnStore func(topicName string, msg *Message[T])
+	// called when a subscriber reaches a message queued in its topic, false skips it for that
+	// subscriber. It runs on the event loop and must not block, the message must not be modified.
+	OnEnqueue func(topicName, subscriberName string, msg *Message[T]) bool
+	// called when a message is delivered to a subscriber (Get, Receive, Consume...), it returns
+	// the message to deliver. The message is shared by the subscribers, return a modified copy.
+	OnDeliver func(topicName, subscriberName string, msg *Message[T]) *Message[T]
+}
+
+// a message refused by a Validate hook, Index is its position in the messages published to Topic
+type MessageError struct {
+	Topic string
+	Index int
+	Err   error
+}
+
+func (e *MessageError) Error() string {
+	return fmt.Sprintf("%s[%d]: %v", e.Topic, e.Index, e.Err)
+}
+
+func (e *MessageError) Unwrap() error {
+	return e.Err
+}
+
+// set the Published time of the messages on publish
+func Timestamp[T any](now func() time.Time) Interceptor[T] {
+	return Interceptor[T]{
+		OnPublish: func(topicName string, msg *Message[T]) error {
+			msg.Published = now()
+			return nil
+		},
+	}
+}
+
+// the value of a redacted field
+const REDACTED = "REDACTED"
+
+// replace the values of the named fields (at any depth) of json messages on delivery,
+// the messages that are not json are delivered as is
+func RedactJSON(fields ...string) Interceptor[string] {
+	redacted := make(map[string]bool, len(fields))
+
+	for _, f := range fields {
+		redacted[f] = true
+	}
+
+	// redact the fields of a decoded json value, returns true if a field was redacted
+	var redact func(v interface{}) bool
+
+	redact = func(v interface{}) bool {
+		changed := false
+
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for name, value := range v {
+				if redacted[name] {
+					v[name] = REDACTED
+					changed = true
+				} else if redact(value) {
+					changed = true
+				}
+			}
+		case []interface{}:
+			for _, value := range v {
+				if redact(value) {
+					changed = true
+				}
+			}
+		}
+
+		return changed
+	}
+
+	return Interceptor[string]{
+		OnDeliver: func(topicName, subscriberName string, msg *PubMessage) *PubMessage {
+			var doc interface{}
+
+			if json.Unmarshal([]byte(msg.Message), &doc) != nil || !redact(doc) {
+				return msg
+			}
+
+			data, err := json.Marshal(doc)
+
+			if err != nil {
+				return msg
+			}
+
+			out := *msg
+			out.Message = string(data)
+
+			return &out
+		},
+	}
+}
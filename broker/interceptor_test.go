@@ -0,0 +1,62 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   This file contains unit tests for the built-in interceptors.
+
+   cmd to execute: "go test"
+
+*/
+
+package broker
+
+import (
+	"testing"
+	"time"
+)
+
+// test that Timestamp sets the publish time
+func TestTimestamp(t *testing.T) {
+	now := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	msg := &PubMessage{Message: "msg"}
+
+	if err := Timestamp[string](func() time.Time { return now }).OnPublish("topic", msg); err != nil || !msg.Published.Equal(now) {
+		t.Errorf("expected the publish time %v, got %v, %v", now, msg.Published, err)
+	}
+}
+
+// test the redaction of json fields on delivery
+func TestRedactJSON(t *testing.T) {
+	deliver := RedactJSON("password", "card").OnDeliver
+
+	for in, want := range map[string]string{
+		`{"user": "bob", "password": "secret"}`:             `{"password":"REDACTED","user":"bob"}`,
+		`[{"card": {"number": 1}}, {"order": {"card": 2}}]`: `[{"card":"REDACTED"},{"order":{"card":"REDACTED"}}]`,
+		`{"user": "bob"}`: `{"user": "bob"}`,
+		`not json`:        `not json`,
+	} {
+		msg := &PubMessage{Message: in, ID: 7}
+		out := deliver("topic", "sub1", msg)
+
+		if out.Message != want || out.ID != 7 {
+			t.Errorf("%s: expected %s, got %+v", in, want, out)
+		}
+
+		if msg.Message != in {
+			t.Errorf("%s: the delivered message was modified in place", in)
+		}
+	}
+}
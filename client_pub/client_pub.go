@@ -28,7 +28,9 @@
 
     $ client_pub -port=6000 -topic=jobs -message=doctor -interval=800 -num=5
 
-    By default it publishes to port 3000 and the default max interval between successive messages is 500 ms
+    By default it publishes to port 3000 and the default max interval between successive messages is 500 ms.
+    A publish that fails is retried (-retries times) with the same Idempotency-Key, so the server drops
+    the duplicates of a publish that timed out but went through.
 
 */
 package main
@@ -58,6 +60,7 @@ func main() {
 	var pubMsg PubMessage
 	var ip string
 	var num int
+	var retries int
 
 	flag.StringVar(&topic_name, "topic", "topic", "specifies the topic to post to")
 	flag.StringVar(&message, "message", "message", "specifies the message to post to the topic")
@@ -65,6 +68,7 @@ func main() {
 	flag.IntVar(&port, "port", 3000, "server port to publish to")
 	flag.StringVar(&ip, "ip", "127.0.0.1", "ip to publish to")
 	flag.IntVar(&num, "num", 1, "number of topics to publish to")
+	flag.IntVar(&retries, "retries", 2, "number of retries of a failed publish")
 
 	flag.Parse()
 
@@ -93,9 +97,10 @@ func main() {
 			rand.Seed(time.Now().Unix())
 
 			t := &http.Transport{}
-			client := &http.Client{Transport: t}
+			client := &http.Client{Transport: t, Timeout: time.Second * 5}
 
 			URL := fmt.Sprintf("http://%s:%d/%s%d", ip, port, topic_name, id)
+			start := time.Now().UnixNano()
 
 			i := 0
 
@@ -113,23 +118,30 @@ func main() {
 						continue
 					}
 
-					req, _ := http.NewRequest("POST", URL, bytes.NewBuffer(b))
+					key := fmt.Sprintf("%d-%d-%d", start, id, i)
 
-					req.Header.Set("Content-Type", "application/json")
+					for attempt := 0; attempt <= retries; attempt++ {
+						req, _ := http.NewRequest("POST", URL, bytes.NewBuffer(b))
 
-					resp, err := client.Do(req)
+						req.Header.Set("Content-Type", "application/json")
+						req.Header.Set("Idempotency-Key", key)
 
-					if err != nil {
-						fmt.Println("Error in get", err)
-						continue
-					}
+						resp, err := client.Do(req)
+
+						if err != nil {
+							fmt.Println("Error in post", err)
+							continue
+						}
+
+						resp.Body.Close()
+
+						if resp.StatusCode == http.StatusNoContent {
+							break
+						}
 
-					if resp.StatusCode != http.StatusNoContent {
 						fmt.Println("Error publishing message")
 					}
 
-					resp.Body.Close()
-
 				case <-done:
 					return
 				}
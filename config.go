@@ -0,0 +1,379 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   Configuration of the PubSub server. The settings are taken, in increasing order of
+   precedence, from the defaults, a json config file (-config or PUBSUB_CONFIG), the
+   environment variables (PUBSUB_PORT...) and the command line flags. They are validated at
+   startup and the server refuses to start with all the problems found. -print-config prints
+   the resulting settings (tokens redacted) and exits.
+
+   {
+       "IP": "127.0.0.1",
+       "Port": 3000,
+       "Backend": "scalable",
+       "Workers": 4,
+       "DefaultBacklog": 100,
+       "Topics": {"orders": {"MaxBacklog": 1000, "Overflow": "reject"}},
+       "Rules": {"audit": {"Source": "orders", "Destination": "audit"}},
+       "Auth": {"Tokens": ["s3cret"], "AdminTokens": ["adm1n"]},
+       "Limits": {"MaxBodyBytes": 1048576, "RequestTimeout": "10s"},
+       "Log": {"Level": "debug", "Format": "json"}
+   }
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/nakdesai/pub-sub/broker"
+	"github.com/nakdesai/pub-sub/pubsub"
+)
+
+// settings of the server, durations are strings like "1m30s"
+type serverConfig struct {
+	IP      string
+	Port    int
+	Backend string // scalable or single
+	// topic managers of the scalable backend, 0 is one per CPU but one
+	Workers int
+	// length of the event queues, 0 is the default of the backend
+	QueueSize          int
+	DefaultBacklog     int
+	DefaultDedupWindow string
+	// Subscribe and Publish create the topics that do not exist
+	AutoCreate bool
+	// topics created at startup, with the settings of PUT /admin/topics/{topic_name}
+	Topics map[string]topicConfig `json:",omitempty"`
+	// forwarding rules set at startup, as set by PUT /admin/rules/{rule_name}
+	Rules  map[string]forwardingRule `json:",omitempty"`
+	Auth   authConfig
+	Limits limitsConfig
+	Log    logConfig
+	Trace  string   // export the message spans to stdout or to a file
+	Redact []string // fields of the json messages redacted on delivery
+}
+
+// bearer tokens accepted by the server, no token at all disables authentication
+type authConfig struct {
+	Tokens      []string // accepted on every endpoint but the admin ones if AdminTokens is set
+	AdminTokens []string // accepted on every endpoint
+}
+
+type limitsConfig struct {
+	MaxBodyBytes    int64  // larger request bodies are refused, 0 is no limit
+	RequestTimeout  string // how long a request waits for its reply when no timeout is given
+	ShutdownTimeout string // how long the requests in flight have to finish on shutdown
+}
+
+type logConfig struct {
+	Level  string // debug, info, warn or error
+	Format string // text or json
+}
+
+// the settings in effect, replaced on reload
+var settings atomic.Pointer[serverConfig]
+
+// the settings in effect, the defaults until they are loaded
+func currentConfig() *serverConfig {
+	if c := settings.Load(); c != nil {
+		return c
+	}
+
+	c := defaultConfig()
+	return &c
+}
+
+// the settings used without a config file
+func defaultConfig() serverConfig {
+	return serverConfig{
+		IP:                 "127.0.0.1",
+		Port:               3000,
+		Backend:            "scalable",
+		DefaultBacklog:     MAX_OUTSTANDING_MESSAGES,
+		DefaultDedupWindow: pubsub.DEDUP_WINDOW.String(),
+		AutoCreate:         true,
+		Limits: limitsConfig{
+			RequestTimeout:  DEFAULT_REQUEST_TIMEOUT.String(),
+			ShutdownTimeout: SHUTDOWN_TIMEOUT.String(),
+		},
+		Log: logConfig{Level: "info", Format: "text"},
+	}
+}
+
+// where the settings come from, they are loaded again on reload
+type configSource struct {
+	file   string          // config file, may be empty
+	flags  serverConfig    // the values of the flags
+	set    map[string]bool // the flags given on the command line
+	redact string          // the -redact flag
+}
+
+// load the settings: the defaults, overridden by the config file, the environment
+// variables and the flags given on the command line. All the problems are reported.
+func (src configSource) load() (serverConfig, error) {
+	c := defaultConfig()
+
+	if src.file != "" {
+		if err := loadConfigFile(src.file, &c); err != nil {
+			return c, err
+		}
+	}
+
+	envErr := applyEnv(&c, os.LookupEnv)
+
+	for name := range src.set {
+		switch name {
+		case "port":
+			c.Port = src.flags.Port
+		case "ip":
+			c.IP = src.flags.IP
+		case "backend":
+			c.Backend = src.flags.Backend
+		case "redact":
+			c.Redact = splitList(src.redact)
+		case "trace":
+			c.Trace = src.flags.Trace
+		case "auto-create":
+			c.AutoCreate = src.flags.AutoCreate
+		case "log-level":
+			c.Log.Level = src.flags.Log.Level
+		case "log-format":
+			c.Log.Format = src.flags.Log.Format
+		case "shutdown-timeout":
+			c.Limits.ShutdownTimeout = src.flags.Limits.ShutdownTimeout
+		}
+	}
+
+	return c, errors.Join(envErr, c.validate())
+}
+
+// read a json config file over c, unknown settings are refused
+func loadConfigFile(path string, c *serverConfig) error {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	return nil
+}
+
+// override c with the environment variables found by lookup (os.LookupEnv)
+func applyEnv(c *serverConfig, lookup func(key string) (string, bool)) error {
+	strs := map[string]*string{
+		"PUBSUB_IP":                   &c.IP,
+		"PUBSUB_BACKEND":              &c.Backend,
+		"PUBSUB_DEFAULT_DEDUP_WINDOW": &c.DefaultDedupWindow,
+		"PUBSUB_REQUEST_TIMEOUT":      &c.Limits.RequestTimeout,
+		"PUBSUB_SHUTDOWN_TIMEOUT":     &c.Limits.ShutdownTimeout,
+		"PUBSUB_LOG_LEVEL":            &c.Log.Level,
+		"PUBSUB_LOG_FORMAT":           &c.Log.Format,
+		"PUBSUB_TRACE":                &c.Trace,
+	}
+
+	ints := map[string]*int{
+		"PUBSUB_PORT":            &c.Port,
+		"PUBSUB_WORKERS":         &c.Workers,
+		"PUBSUB_QUEUE_SIZE":      &c.QueueSize,
+		"PUBSUB_DEFAULT_BACKLOG": &c.DefaultBacklog,
+	}
+
+	// comma separated
+	lists := map[string]*[]string{
+		"PUBSUB_AUTH_TOKENS":  &c.Auth.Tokens,
+		"PUBSUB_ADMIN_TOKENS": &c.Auth.AdminTokens,
+		"PUBSUB_REDACT":       &c.Redact,
+	}
+
+	var errs []error
+
+	for key, p := range strs {
+		if v, ok := lookup(key); ok {
+			*p = v
+		}
+	}
+
+	for key, p := range ints {
+		if v, ok := lookup(key); ok {
+			n, err := strconv.Atoi(v)
+
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a number", key, v))
+				continue
+			}
+
+			*p = n
+		}
+	}
+
+	for key, p := range lists {
+		if v, ok := lookup(key); ok {
+			*p = splitList(v)
+		}
+	}
+
+	if v, ok := lookup("PUBSUB_AUTO_CREATE"); ok {
+		on, err := strconv.ParseBool(v)
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("PUBSUB_AUTO_CREATE: %q is not a boolean", v))
+		} else {
+			c.AutoCreate = on
+		}
+	}
+
+	if v, ok := lookup("PUBSUB_MAX_BODY_BYTES"); ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("PUBSUB_MAX_BODY_BYTES: %q is not a number", v))
+		} else {
+			c.Limits.MaxBodyBytes = n
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// split a comma separated list, the empty string is an empty list
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	return strings.Split(s, ",")
+}
+
+// check the settings, all the problems found are reported
+func (c serverConfig) validate() error {
+	var errs []error
+
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Port < 0 || c.Port > 65535 {
+		fail("Port: %d is not a port number", c.Port)
+	}
+
+	if c.Backend != "scalable" && c.Backend != "single" {
+		fail("Backend: unknown backend %q, expected scalable or single", c.Backend)
+	}
+
+	if c.Workers < 0 {
+		fail("Workers: must not be negative, got %d", c.Workers)
+	}
+
+	if c.QueueSize < 0 {
+		fail("QueueSize: must not be negative, got %d", c.QueueSize)
+	}
+
+	if c.DefaultBacklog <= 0 {
+		fail("DefaultBacklog: must be positive, got %d", c.DefaultBacklog)
+	}
+
+	for name, s := range map[string]string{
+		"DefaultDedupWindow":     c.DefaultDedupWindow,
+		"Limits.RequestTimeout":  c.Limits.RequestTimeout,
+		"Limits.ShutdownTimeout": c.Limits.ShutdownTimeout,
+	} {
+		if d, err := parseDuration(s); err != nil || d < 0 {
+			fail("%s: invalid duration %q", name, s)
+		}
+	}
+
+	for topicName, tc := range c.Topics {
+		if reservedTopics[topicName] {
+			fail("Topics.%s: reserved topic name", topicName)
+		} else if _, err := tc.parse(); err != nil {
+			fail("Topics.%s: %v", topicName, err)
+		}
+	}
+
+	for name, fr := range c.Rules {
+		if _, err := fr.compile(); err != nil || fr.Source == "" || fr.Destination == "" {
+			fail("Rules.%s: %v", name, broker.ErrInvalidRule)
+		}
+	}
+
+	for _, token := range append(c.Auth.Tokens, c.Auth.AdminTokens...) {
+		if strings.TrimSpace(token) == "" {
+			fail("Auth: empty token")
+		}
+	}
+
+	if c.Limits.MaxBodyBytes < 0 {
+		fail("Limits.MaxBodyBytes: must not be negative, got %d", c.Limits.MaxBodyBytes)
+	}
+
+	if _, err := parseLevel(c.Log.Level); err != nil {
+		fail("Log.Level: %v", err)
+	}
+
+	if _, err := newLogger(io.Discard, slog.LevelInfo, c.Log.Format); err != nil {
+		fail("Log.Format: %v", err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// the settings as printed by -print-config, with the tokens redacted
+func (c serverConfig) redacted() serverConfig {
+	redact := func(tokens []string) []string {
+		out := make([]string, len(tokens))
+
+		for i := range out {
+			out[i] = "<redacted>"
+		}
+
+		return out
+	}
+
+	c.Auth = authConfig{Tokens: redact(c.Auth.Tokens), AdminTokens: redact(c.Auth.AdminTokens)}
+
+	return c
+}
+
+// refuse the request bodies larger than Limits.MaxBodyBytes
+func limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if max := currentConfig().Limits.MaxBodyBytes; max > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,190 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   Forwarding rules of the PubSub server. A rule copies the messages published to a topic to
+   another topic, optionally filtered and transformed. The rules are managed with the admin
+   endpoints under /admin/rules and can be loaded at startup from a json file (-rules).
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/nakdesai/pub-sub/broker"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// json representation of a forwarding rule
+type forwardingRule struct {
+	Source      string
+	Destination string
+	Filter      *messageFilter    `json:",omitempty"`
+	Transform   *messageTransform `json:",omitempty"`
+}
+
+// forward only the messages matching all the fields set
+type messageFilter struct {
+	Key         string `json:",omitempty"` // ordering key
+	Contains    string `json:",omitempty"` // part of the message
+	MinPriority int    `json:",omitempty"`
+}
+
+// rewrite of the forwarded messages
+type messageTransform struct {
+	Prefix   string `json:",omitempty"` // prepended to the message
+	Suffix   string `json:",omitempty"` // appended to the message
+	Priority *int   `json:",omitempty"` // replaces the priority
+}
+
+// the rules set through the server by name, as given (the broker only holds their functions)
+var rules = struct {
+	sync.Mutex
+	byName map[string]forwardingRule
+}{byName: make(map[string]forwardingRule)}
+
+// build the broker rule
+func (fr forwardingRule) compile() (broker.ForwardingRule[string], error) {
+	rule := broker.ForwardingRule[string]{Source: fr.Source, Destination: fr.Destination}
+
+	if reservedTopics[fr.Source] || reservedTopics[fr.Destination] {
+		return rule, broker.ErrInvalidRule
+	}
+
+	if f := fr.Filter; f != nil {
+		rule.Filter = func(msg *broker.PubMessage) bool {
+			return (f.Key == "" || msg.Key == f.Key) &&
+				strings.Contains(msg.Message, f.Contains) &&
+				msg.Priority >= f.MinPriority
+		}
+	}
+
+	if tr := fr.Transform; tr != nil {
+		if tr.Priority != nil && (*tr.Priority < 0 || *tr.Priority > broker.MAX_PRIORITY) {
+			return rule, broker.ErrInvalidRule
+		}
+
+		rule.Transform = func(msg *broker.PubMessage) {
+			msg.Message = tr.Prefix + msg.Message + tr.Suffix
+
+			if tr.Priority != nil {
+				msg.Priority = *tr.Priority
+			}
+		}
+	}
+
+	return rule, nil
+}
+
+// set a forwarding rule in the broker and remember it
+func setRule(name string, fr forwardingRule) error {
+	rules.Lock()
+	defer rules.Unlock()
+
+	rule, err := fr.compile()
+
+	if err != nil {
+		return err
+	}
+
+	if err := pb.SetForwardingRule(name, rule); err != nil {
+		return err
+	}
+
+	rules.byName[name] = fr
+
+	return nil
+}
+
+// delete a forwarding rule from the broker and forget it
+func removeRule(name string) error {
+	rules.Lock()
+	defer rules.Unlock()
+
+	if err := pb.DeleteForwardingRule(name); err != nil {
+		return err
+	}
+
+	delete(rules.byName, name)
+
+	return nil
+}
+
+// set the forwarding rules of a json file mapping rule names to rules
+func loadRules(path string) error {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	var byName map[string]forwardingRule
+
+	if err := json.Unmarshal(data, &byName); err != nil {
+		return err
+	}
+
+	for name, fr := range byName {
+		if err := setRule(name, fr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// create or replace a forwarding rule
+func putRule(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var fr forwardingRule
+
+	if err := json.NewDecoder(r.Body).Decode(&fr); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := setRule(params.ByName("rule_name"), fr); err != nil {
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// delete a forwarding rule
+func deleteRule(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if err := removeRule(params.ByName("rule_name")); err != nil {
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// list the forwarding rules by name
+func listRules(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	rules.Lock()
+	defer rules.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules.byName)
+}
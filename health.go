@@ -0,0 +1,99 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   Health checks of the PubSub server for the orchestrator:
+
+   GET /healthz (liveness)  the event loops of the broker answer a ping in time
+   GET /readyz (readiness)  the same, and the server is not shutting down
+
+   The server has no persistent storage, so there is no storage check.
+
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/nakdesai/pub-sub/broker"
+)
+
+// how long the event loops have to answer a health check
+const HEALTH_TIMEOUT = time.Second
+
+// result of a health check, by check
+type healthStatus struct {
+	Status string
+	Checks map[string]string
+}
+
+// ping the event loops of the broker, a closed broker only fails the readiness
+func check(ready bool) (int, healthStatus) {
+	ctx, cancel := context.WithTimeout(context.Background(), HEALTH_TIMEOUT)
+	defer cancel()
+
+	status := healthStatus{Status: "ok", Checks: map[string]string{"event_loops": "ok"}}
+	err := pb.Ping(ctx)
+
+	if ready && shuttingDown.Load() {
+		status.Checks["shutdown"] = "in progress"
+		status.Status = "unavailable"
+	}
+
+	switch err {
+	case nil:
+	case broker.ErrClosed:
+		status.Checks["event_loops"] = "closed"
+
+		if ready {
+			status.Status = "unavailable"
+		}
+	case context.DeadlineExceeded:
+		status.Checks["event_loops"] = "no answer within " + HEALTH_TIMEOUT.String()
+		status.Status = "unavailable"
+	default:
+		status.Checks["event_loops"] = err.Error()
+		status.Status = "unavailable"
+	}
+
+	if status.Status != "ok" {
+		return http.StatusServiceUnavailable, status
+	}
+
+	return http.StatusOK, status
+}
+
+func writeHealth(w http.ResponseWriter, code int, status healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
+
+// liveness check, the process keeps answering while it shuts down
+func healthz(w http.ResponseWriter, r *http.Request) {
+	code, status := check(false)
+	writeHealth(w, code, status)
+}
+
+// readiness check, fails once the server is shutting down
+func readyz(w http.ResponseWriter, r *http.Request) {
+	code, status := check(true)
+	writeHealth(w, code, status)
+}
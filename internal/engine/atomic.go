@@ -0,0 +1,197 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   This file contains the atomic publish to several topics. The shards owning the topics are
+   locked in index order (so concurrent transactions cannot deadlock): each one checks that
+   its messages can be published and then blocks its event loop. Once all of them are ready
+   they publish, and they are released together, so no reader sees a part of the messages.
+
+*/
+
+package engine
+
+import (
+	"sort"
+	"time"
+
+	"github.com/nakdesai/pub-sub/broker"
+)
+
+// the part of an atomic publish owned by a shard
+type txn[T any] struct {
+	batches map[string][]*broker.Message[T] // messages by topic
+	commit  chan bool                       // true to publish the messages, false to abort
+	applied chan struct{}                   // the messages have been published
+	release chan struct{}                   // closed once all the shards have published
+	stored  map[string][]*broker.Message[T] // the messages stored (not the duplicates), by topic
+}
+
+// check that the messages can be published to a topic without creating it
+func (sh *shard[T]) canPublish(topicName string, msgs []*broker.Message[T], now time.Time) error {
+	t, found := sh.lookup(topicName, now)
+
+	if !found {
+		if _, ok := sh.autoCreate(topicName); !ok {
+			return broker.ErrTopicNotFound
+		}
+
+		return nil
+	}
+
+	// only DropOldest makes room, DropNewest would discard a part of the transaction
+	if t.config.Overflow != broker.DropOldest && !t.Fits(msgs) {
+		return broker.ErrQueueFull
+	}
+
+	return nil
+}
+
+// take part in an atomic publish, the event loop is blocked until the transaction is over
+func (sh *shard[T]) handleTxn(r *request[T], now time.Time) {
+	tx := r.txn
+
+	for topicName, msgs := range tx.batches {
+		if err := sh.canPublish(topicName, msgs, now); err != nil {
+			r.result <- response[T]{err: err}
+			return
+		}
+	}
+
+	r.result <- response[T]{}
+
+	if !<-tx.commit {
+		return
+	}
+
+	for topicName, msgs := range tx.batches {
+		t, _ := sh.lookupOrCreate(topicName, now)
+		t.lastActive = now
+
+		for _, msg := range msgs {
+			if sh.publish(t, msg, now) {
+				tx.stored[topicName] = append(tx.stored[topicName], msg)
+			}
+		}
+
+		t.wakeWaiters(now)
+	}
+
+	tx.applied <- struct{}{}
+	<-tx.release
+}
+
+// publish messages to several topics, possibly owned by different shards, all of them or
+// none. It fails if a topic does not exist (and cannot be created) or if a topic with the
+// DropNewest or Reject overflow policy does not have room for its messages.
+func (e *Engine[T]) PublishAtomic(batches map[string][]*broker.Message[T]) error {
+	for topicName, msgs := range batches {
+		if err := e.chain.publish(topicName, msgs); err != nil {
+			return err
+		}
+
+		if err := validPriorities(msgs...); err != nil {
+			return err
+		}
+
+		if err := e.chain.validate(topicName, msgs); err != nil {
+			return err
+		}
+	}
+
+	release := make(chan struct{})
+	txns := make(map[int]*txn[T])
+
+	for topicName, msgs := range batches {
+		if len(msgs) == 0 {
+			continue
+		}
+
+		idx := e.shardOf(topicName)
+
+		if txns[idx] == nil {
+			txns[idx] = &txn[T]{
+				batches: make(map[string][]*broker.Message[T]),
+				commit:  make(chan bool, 1),
+				applied: make(chan struct{}, 1),
+				release: release,
+				stored:  make(map[string][]*broker.Message[T]),
+			}
+		}
+
+		txns[idx].batches[topicName] = msgs
+	}
+
+	idxs := make([]int, 0, len(txns))
+
+	for idx := range txns {
+		idxs = append(idxs, idx)
+	}
+
+	sort.Ints(idxs)
+
+	return e.runTxns(txns, idxs, release)
+}
+
+// run the transactions of the shards in index order
+func (e *Engine[T]) runTxns(txns map[int]*txn[T], idxs []int, release chan struct{}) error {
+	// Close waits for the transaction to be over before closing the event queues
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return broker.ErrClosed
+	}
+
+	var locked []*txn[T]
+
+	abort := func() {
+		for _, tx := range locked {
+			tx.commit <- false
+		}
+	}
+
+	for _, idx := range idxs {
+		r := &request[T]{action: TXN_PUBLISH, txn: txns[idx], result: make(chan response[T], 1)}
+		e.shards[idx] <- r
+
+		if err := (<-r.result).err; err != nil {
+			abort()
+			return err
+		}
+
+		locked = append(locked, txns[idx])
+	}
+
+	for _, tx := range locked {
+		tx.commit <- true
+	}
+
+	for _, tx := range locked {
+		<-tx.applied
+	}
+
+	close(release)
+
+	// the forwarded messages are not part of the transaction
+	for _, tx := range locked {
+		for topicName, msgs := range tx.stored {
+			e.forward(topicName, msgs)
+		}
+	}
+
+	return nil
+}
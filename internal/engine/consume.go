@@ -0,0 +1,230 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   This file contains the push consumers. A consumer runs a pool of goroutines pulling the
+   messages of a subscriber with Receive and passing them to a handler. A message the handler
+   fails on (or panics on) is requeued in front of the subscriber's log, so it is retried by
+   any of the workers.
+
+*/
+
+package engine
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nakdesai/pub-sub/broker"
+)
+
+// a running Consume
+type consumer[T any] struct {
+	e          *Engine[T]
+	topicName  string
+	subscriber string
+	handler    broker.Handler[T]
+	opts       broker.ConsumeOptions
+
+	recvCtx    context.Context // cancelled to stop pulling messages
+	stopRecv   context.CancelFunc
+	handlerCtx context.Context // cancelled when a Stop times out
+	stopHandle context.CancelFunc
+
+	mu       sync.Mutex
+	attempts map[*broker.Message[T]]int // failed deliveries of the messages being retried
+	err      error
+
+	wg   sync.WaitGroup
+	done chan struct{}
+}
+
+// push the messages of a subscriber to handler. If the topic or the subscriber does not
+// exist (or goes away) the consumer stops on its own, see Err.
+func (e *Engine[T]) Consume(topicName, subscriberName string, handler broker.Handler[T], opts broker.ConsumeOptions) (broker.Consumer, error) {
+	if handler == nil || opts.Concurrency < 0 || opts.MaxAttempts < 0 || opts.RetryDelay < 0 {
+		return nil, broker.ErrInvalidConsumeOptions
+	}
+
+	if opts.Concurrency == 0 {
+		opts.Concurrency = 1
+	}
+
+	c := &consumer[T]{
+		e:          e,
+		topicName:  topicName,
+		subscriber: subscriberName,
+		handler:    handler,
+		opts:       opts,
+		attempts:   make(map[*broker.Message[T]]int),
+		done:       make(chan struct{}),
+	}
+
+	c.recvCtx, c.stopRecv = context.WithCancel(context.Background())
+	c.handlerCtx, c.stopHandle = context.WithCancel(context.Background())
+
+	for i := 0; i < opts.Concurrency; i++ {
+		c.wg.Add(1)
+
+		go func() {
+			defer c.wg.Done()
+			c.run()
+		}()
+	}
+
+	go func() {
+		c.wg.Wait()
+		c.stopRecv()
+		c.stopHandle()
+		close(c.done)
+	}()
+
+	return c, nil
+}
+
+// worker loop, it exits once the consumer is stopped or Receive fails
+func (c *consumer[T]) run() {
+	for {
+		msg, err := c.e.receive(c.recvCtx, c.topicName, c.subscriber)
+
+		if err != nil {
+			if c.recvCtx.Err() == nil {
+				c.fail(err)
+			}
+
+			return
+		}
+
+		c.deliver(msg)
+	}
+}
+
+// record why the consumer stopped and stop the other workers
+func (c *consumer[T]) fail(err error) {
+	c.mu.Lock()
+
+	if c.err == nil {
+		c.err = err
+	}
+
+	c.mu.Unlock()
+
+	c.e.log.Info("consumer stopped", "topic", c.topicName, "subscriber", c.subscriber, "err", err)
+
+	c.stopRecv()
+}
+
+// call the handler, converting a panic into an error
+func (c *consumer[T]) call(msg *broker.Message[T]) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("engine: handler panic: %v", p)
+		}
+	}()
+
+	return c.handler(c.handlerCtx, msg)
+}
+
+// handle a message, retrying it later if the handler fails
+func (c *consumer[T]) deliver(msg *broker.Message[T]) {
+	// the message as received is the one retried
+	err := c.call(c.e.chain.deliver(c.topicName, c.subscriber, msg))
+
+	c.mu.Lock()
+
+	if err == nil {
+		delete(c.attempts, msg)
+		c.mu.Unlock()
+		c.ack(msg)
+		return
+	}
+
+	c.attempts[msg]++
+	attempt := c.attempts[msg]
+	dropped := c.opts.MaxAttempts > 0 && attempt >= c.opts.MaxAttempts
+
+	if dropped {
+		delete(c.attempts, msg)
+	}
+
+	c.mu.Unlock()
+
+	if dropped {
+		c.e.log.Error("handler failed, message dropped", "topic", c.topicName, "subscriber", c.subscriber,
+			"id", msg.ID, "attempt", attempt, "err", err)
+	} else {
+		c.e.log.Warn("handler failed", "topic", c.topicName, "subscriber", c.subscriber,
+			"id", msg.ID, "attempt", attempt, "err", err)
+	}
+
+	if c.opts.OnError != nil {
+		c.opts.OnError(err, attempt, dropped)
+	}
+
+	if dropped {
+		c.ack(msg)
+		return
+	}
+
+	// a stopping consumer requeues right away, the next consumer retries the message
+	if c.opts.RetryDelay > 0 {
+		timer := time.NewTimer(c.opts.RetryDelay)
+
+		select {
+		case <-timer.C:
+		case <-c.recvCtx.Done():
+			timer.Stop()
+		}
+	}
+
+	c.e.call(&request[T]{action: REQUEUE_MSG, key: c.topicName, subscriber: c.subscriber, msg: msg})
+}
+
+// release the ordering key of a handled (or dropped) message
+func (c *consumer[T]) ack(msg *broker.Message[T]) {
+	if msg.Key != "" {
+		c.e.Ack(c.topicName, c.subscriber, msg.ID)
+	}
+}
+
+// stop pulling messages and wait for the handlers in flight, their context is cancelled once ctx is done
+func (c *consumer[T]) Stop(ctx context.Context) error {
+	c.stopRecv()
+
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		c.stopHandle()
+		<-c.done
+		return ctx.Err()
+	}
+}
+
+// closed once the consumer has stopped
+func (c *consumer[T]) Done() <-chan struct{} {
+	return c.done
+}
+
+// why the consumer stopped on its own, nil after Stop
+func (c *consumer[T]) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
@@ -0,0 +1,69 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   This file contains the publish deduplication. A message published with an idempotency key
+   already seen on the topic within its dedup window is dropped, and the publisher gets the id
+   of the original message, so a publisher can safely retry a publish that timed out.
+
+*/
+
+package engine
+
+import (
+	"time"
+
+	"github.com/nakdesai/pub-sub/broker"
+)
+
+// an idempotency key seen on publish
+type seenKey struct {
+	id      uint64    // id of the original message
+	expires time.Time // end of the dedup window
+}
+
+// check if a message was already published, its id is then set to the one of the original
+func (t *topicState[T]) duplicate(msg *broker.Message[T], now time.Time) bool {
+	if msg.IdempotencyKey == "" || t.config.DedupWindow <= 0 {
+		return false
+	}
+
+	seen, found := t.seen[msg.IdempotencyKey]
+
+	if !found || !now.Before(seen.expires) {
+		return false
+	}
+
+	msg.ID = seen.id
+
+	return true
+}
+
+// remember the idempotency key of a published message for the dedup window
+func (t *topicState[T]) remember(msg *broker.Message[T], now time.Time) {
+	if msg.IdempotencyKey != "" && t.config.DedupWindow > 0 {
+		t.seen[msg.IdempotencyKey] = seenKey{id: msg.ID, expires: now.Add(t.config.DedupWindow)}
+	}
+}
+
+// forget the idempotency keys whose dedup window is over
+func (t *topicState[T]) forgetExpired(now time.Time) {
+	for key, seen := range t.seen {
+		if !now.Before(seen.expires) {
+			delete(t.seen, key)
+		}
+	}
+}
@@ -0,0 +1,742 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+
+   The engine package implements the event loop shared by the pubsub and pubsubScalable
+   packages. The topic key space is split across a fixed number of shards, each owned by a
+   goroutine pulling requests from its own event queue (the topic name is hashed to pick
+   the shard). pubsub runs a single shard, pubsubScalable one per worker.
+
+*/
+
+package engine
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/nakdesai/pub-sub/broker"
+)
+
+// source of the current time, it can be replaced in tests
+type Clock interface {
+	Now() time.Time
+}
+
+// settings of an Engine
+type Config struct {
+	Shards        int                       // number of shard goroutines, at least 1
+	QueueSize     int                       // length of the event queue of each shard
+	DefaultConfig broker.TopicConfig        // settings of the topics created implicitly
+	Hash          func(topic string) uint32 // maps a topic name to its shard, may be nil with a single shard
+	Clock         Clock
+	Logger        *slog.Logger // nil logs nothing
+}
+
+// request event struct
+type request[T any] struct {
+	action     req
+	key        string
+	subscriber string
+	msg        *broker.Message[T]
+	msgs       []*broker.Message[T]
+	count      int    // maximum number of messages to get
+	id         uint64 // message to ack
+	config     broker.TopicConfig
+	waiter     *request[T] // the blocked Receive to cancel
+	txn        *txn[T]
+	result     chan response[T]
+}
+
+// response event struct
+type response[T any] struct {
+	msg    *broker.Message[T]
+	msgs   []*broker.Message[T]
+	topics []string
+	config broker.TopicConfig
+	err    error
+}
+
+// owner of a part of the topic key space
+type shard[T any] struct {
+	topicMap      map[string]*topicState[T]
+	expired       map[string]broker.TopicConfig // settings of the expired topics that differ from the default
+	defaultConfig broker.TopicConfig
+	clock         Clock
+	chain         *chain[T]
+	log           *slog.Logger
+	eventQueue    chan *request[T]
+	abort         chan struct{} // closed to stop draining the event queue
+}
+
+// Engine implements broker.Broker on top of the shards
+type Engine[T any] struct {
+	shards        []chan *request[T]
+	hash          func(topic string) uint32
+	defaultConfig broker.TopicConfig
+	chain         *chain[T]
+	log           *slog.Logger
+
+	// guards closed, requests are only queued while it is false
+	mu     sync.RWMutex
+	closed bool
+
+	abort     chan struct{} // closed to stop draining the event queues
+	abortOnce sync.Once
+	done      chan struct{} // closed when all the shards have exited
+
+	// guards the forwarding rules
+	rulesMu  sync.RWMutex
+	rules    map[string]broker.ForwardingRule[T]
+	bySource map[string][]broker.ForwardingRule[T]
+}
+
+type req int
+
+const (
+	ADD_SUB req = iota
+	DEL_SUB
+	GET_MSG
+	POST_MSG
+	ADD_TOPIC
+	DEL_TOPIC
+	GET_TOPIC
+	LIST_TOPICS
+	RECV_MSG
+	CANCEL_RECV
+	REQUEUE_MSG
+	POST_BATCH
+	GET_BATCH
+	TXN_PUBLISH
+	ACK_MSG
+	PING
+	SET_TOPIC
+)
+
+// how often idle topics are checked for expiry
+const SWEEP_INTERVAL = time.Second
+
+// start the shards of a new Engine, the config is assumed to be valid
+func New[T any](config Config) *Engine[T] {
+	if config.Logger == nil {
+		config.Logger = slog.New(slog.DiscardHandler)
+	}
+
+	e := &Engine[T]{
+		shards:        make([]chan *request[T], config.Shards),
+		hash:          config.Hash,
+		defaultConfig: config.DefaultConfig,
+		abort:         make(chan struct{}),
+		done:          make(chan struct{}),
+		rules:         make(map[string]broker.ForwardingRule[T]),
+		chain:         &chain[T]{},
+		log:           config.Logger,
+	}
+
+	var wg sync.WaitGroup
+
+	for i := range e.shards {
+		sh := &shard[T]{
+			defaultConfig: config.DefaultConfig,
+			clock:         config.Clock,
+			chain:         e.chain,
+			log:           config.Logger.With("shard", i),
+			eventQueue:    make(chan *request[T], config.QueueSize),
+			abort:         e.abort,
+		}
+
+		e.shards[i] = sh.eventQueue
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			sh.run()
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(e.done)
+	}()
+
+	return e
+}
+
+// look up a topic, deleting it if it has expired
+func (sh *shard[T]) lookup(topicName string, now time.Time) (*topicState[T], bool) {
+	t, found := sh.topicMap[topicName]
+
+	if found && t.expired(now) {
+		sh.log.Info("topic expired", "topic", topicName, "ttl", t.config.TTL)
+		delete(sh.topicMap, topicName)
+
+		// remembered for its AutoCreate
+		if t.config != sh.defaultConfig {
+			sh.expired[topicName] = t.config
+		}
+
+		t.failWaiters(broker.ErrTopicNotFound)
+		return nil, false
+	}
+
+	return t, found
+}
+
+// the settings a missing topic is created with: the ones it had before it expired or the
+// default ones, false if they do not allow auto creation (reply topics are never auto created)
+func (sh *shard[T]) autoCreate(topicName string) (broker.TopicConfig, bool) {
+	config, found := sh.expired[topicName]
+
+	if !found {
+		config = sh.defaultConfig
+	}
+
+	return config, config.AutoCreate && !isReplyTopic(topicName)
+}
+
+// look up a topic, creating it if auto creation is allowed
+func (sh *shard[T]) lookupOrCreate(topicName string, now time.Time) (*topicState[T], bool) {
+	if t, found := sh.lookup(topicName, now); found {
+		return t, true
+	}
+
+	config, ok := sh.autoCreate(topicName)
+
+	if !ok {
+		return nil, false
+	}
+
+	t := newTopicState[T](topicName, config, sh.chain, now)
+	sh.topicMap[topicName] = t
+	delete(sh.expired, topicName)
+	sh.log.Debug("topic created", "topic", topicName)
+	return t, true
+}
+
+// publish a message to a topic, false if it is not stored: a duplicate within the dedup
+// window, or discarded because the topic is full (logged). Only the stored ones are forwarded.
+func (sh *shard[T]) publish(t *topicState[T], msg *broker.Message[T], now time.Time) bool {
+	if t.duplicate(msg, now) {
+		return false
+	}
+
+	if t.publish(msg, now) {
+		sh.chain.store(t.name, msg)
+		return true
+	}
+
+	sh.log.Warn("topic full, message dropped", "topic", t.name, "overflow", t.config.Overflow)
+	return false
+}
+
+// shard goroutine to pull events from the event queue (channel) and process them
+func (sh *shard[T]) run() {
+	sh.topicMap = make(map[string]*topicState[T])
+	sh.expired = make(map[string]broker.TopicConfig)
+
+	sweep := time.NewTicker(SWEEP_INTERVAL)
+	sh.log.Debug("event loop started")
+
+	// on cleanup fail the blocked receivers and drop the topic logs
+	defer func() {
+		sweep.Stop()
+
+		for _, t := range sh.topicMap {
+			t.failWaiters(broker.ErrClosed)
+		}
+
+		sh.topicMap = nil
+		sh.log.Debug("event loop stopped")
+	}()
+
+	// event loop, it exits once Close has closed the event queue and the pending
+	// requests have been processed (or failed if draining was aborted)
+	for {
+		select {
+		case r, ok := <-sh.eventQueue:
+			if !ok {
+				return
+			}
+
+			select {
+			case <-sh.abort:
+				r.result <- response[T]{err: broker.ErrClosed}
+			default:
+				sh.handle(r)
+			}
+
+		case <-sweep.C:
+			now := sh.clock.Now()
+
+			for topicName := range sh.topicMap {
+				if t, found := sh.lookup(topicName, now); found {
+					t.forgetExpired(now)
+
+					// hand the messages past their ack deadline to the blocked receivers
+					if t.config.AckTimeout > 0 {
+						t.wakeWaiters(now)
+					}
+				}
+			}
+		}
+	}
+}
+
+// process a single event
+func (sh *shard[T]) handle(r *request[T]) {
+	now := sh.clock.Now()
+
+	switch r.action {
+
+	case ADD_SUB:
+		if t, found := sh.lookupOrCreate(r.key, now); found {
+			t.lastActive = now
+
+			if t.HasSubscriber(r.subscriber) {
+				r.result <- response[T]{err: broker.ErrSubscriberExists}
+			} else {
+				t.Subscribe(r.subscriber)
+				r.result <- response[T]{}
+			}
+		} else {
+			r.result <- response[T]{err: broker.ErrTopicNotFound}
+		}
+
+	case DEL_SUB:
+		if t, found := sh.lookup(r.key, now); found {
+			t.lastActive = now
+
+			if t.Unsubscribe(r.subscriber) {
+				delete(t.requeued, r.subscriber)
+				delete(t.ordering, r.subscriber)
+				t.failSubscriberWaiters(r.subscriber, broker.ErrSubNotFound)
+				r.result <- response[T]{}
+			} else {
+				r.result <- response[T]{err: broker.ErrSubNotFound}
+			}
+		} else {
+			r.result <- response[T]{err: broker.ErrTopicNotFound}
+		}
+
+	case POST_MSG:
+		// the message is stored once in the topic log, subscribers read it through their cursors.
+		// The response holds it only if it is stored, a duplicate is not an error.
+		if t, found := sh.lookupOrCreate(r.key, now); found {
+			t.lastActive = now
+
+			if sh.publish(t, r.msg, now) {
+				t.wakeWaiters(now)
+				r.result <- response[T]{msgs: []*broker.Message[T]{r.msg}}
+			} else if t.config.Overflow != broker.Reject || t.duplicate(r.msg, now) {
+				r.result <- response[T]{}
+			} else {
+				r.result <- response[T]{err: broker.ErrQueueFull}
+			}
+		} else {
+			r.result <- response[T]{err: broker.ErrTopicNotFound}
+		}
+
+	case POST_BATCH:
+		// with the reject policy the batch is published whole or not at all
+		if t, found := sh.lookupOrCreate(r.key, now); found {
+			t.lastActive = now
+
+			if t.config.Overflow == broker.Reject && !t.Fits(r.msgs) {
+				r.result <- response[T]{err: broker.ErrQueueFull}
+			} else {
+				var stored []*broker.Message[T]
+
+				for _, msg := range r.msgs {
+					if sh.publish(t, msg, now) {
+						stored = append(stored, msg)
+					}
+				}
+
+				t.wakeWaiters(now)
+				r.result <- response[T]{msgs: stored}
+			}
+		} else {
+			r.result <- response[T]{err: broker.ErrTopicNotFound}
+		}
+
+	case GET_MSG:
+		if t, found := sh.lookup(r.key, now); found {
+			t.lastActive = now
+
+			if t.HasSubscriber(r.subscriber) {
+				if msg, ok := t.next(r.subscriber, now); ok {
+					r.result <- response[T]{msg: msg}
+				} else {
+					r.result <- response[T]{err: broker.ErrNoNewMessages}
+				}
+			} else {
+				r.result <- response[T]{err: broker.ErrSubNotFound}
+			}
+		} else {
+			r.result <- response[T]{err: broker.ErrTopicNotFound}
+		}
+
+	case GET_BATCH:
+		if t, found := sh.lookup(r.key, now); found {
+			t.lastActive = now
+
+			if t.HasSubscriber(r.subscriber) {
+				var msgs []*broker.Message[T]
+
+				for len(msgs) < r.count {
+					msg, ok := t.next(r.subscriber, now)
+
+					if !ok {
+						break
+					}
+
+					msgs = append(msgs, msg)
+				}
+
+				if len(msgs) > 0 {
+					r.result <- response[T]{msgs: msgs}
+				} else {
+					r.result <- response[T]{err: broker.ErrNoNewMessages}
+				}
+			} else {
+				r.result <- response[T]{err: broker.ErrSubNotFound}
+			}
+		} else {
+			r.result <- response[T]{err: broker.ErrTopicNotFound}
+		}
+
+	case ADD_TOPIC:
+		if _, found := sh.lookup(r.key, now); found {
+			r.result <- response[T]{err: broker.ErrTopicExists}
+		} else {
+			sh.topicMap[r.key] = newTopicState[T](r.key, r.config, sh.chain, now)
+			delete(sh.expired, r.key)
+			sh.log.Info("topic created", "topic", r.key)
+			r.result <- response[T]{}
+		}
+
+	case DEL_TOPIC:
+		// a deleted topic is forgotten, unlike an expired one
+		t, found := sh.lookup(r.key, now)
+		delete(sh.expired, r.key)
+
+		if found {
+			delete(sh.topicMap, r.key)
+			t.failWaiters(broker.ErrTopicNotFound)
+			sh.log.Info("topic deleted", "topic", r.key)
+			r.result <- response[T]{}
+		} else {
+			r.result <- response[T]{err: broker.ErrTopicNotFound}
+		}
+
+	case SET_TOPIC:
+		if t, found := sh.lookup(r.key, now); found {
+			if lost := t.reconfigure(r.config); lost > 0 {
+				sh.log.Warn("backlog shrunk, messages dropped", "topic", r.key, "dropped", lost)
+			}
+
+			sh.log.Info("topic reconfigured", "topic", r.key)
+			r.result <- response[T]{}
+		} else {
+			r.result <- response[T]{err: broker.ErrTopicNotFound}
+		}
+
+	case GET_TOPIC:
+		if t, found := sh.lookup(r.key, now); found {
+			r.result <- response[T]{config: t.config}
+		} else {
+			r.result <- response[T]{err: broker.ErrTopicNotFound}
+		}
+
+	case LIST_TOPICS:
+		names := make([]string, 0, len(sh.topicMap))
+
+		for topicName := range sh.topicMap {
+			if _, found := sh.lookup(topicName, now); found {
+				names = append(names, topicName)
+			}
+		}
+
+		r.result <- response[T]{topics: names}
+
+	case RECV_MSG:
+		// like GET_MSG, but the request is parked until a message is published
+		if t, found := sh.lookup(r.key, now); found {
+			t.lastActive = now
+
+			if !t.HasSubscriber(r.subscriber) {
+				r.result <- response[T]{err: broker.ErrSubNotFound}
+			} else if msg, ok := t.next(r.subscriber, now); ok {
+				r.result <- response[T]{msg: msg}
+			} else {
+				t.addWaiter(r)
+			}
+		} else {
+			r.result <- response[T]{err: broker.ErrTopicNotFound}
+		}
+
+	case CANCEL_RECV:
+		// the waiter may already have been answered, or its topic deleted
+		if t, found := sh.topicMap[r.key]; found {
+			t.removeWaiter(r.waiter)
+		}
+
+		r.result <- response[T]{}
+
+	case ACK_MSG:
+		if t, found := sh.lookup(r.key, now); found {
+			t.lastActive = now
+
+			if t.HasSubscriber(r.subscriber) {
+				r.result <- response[T]{err: t.ack(r.subscriber, r.id, now)}
+			} else {
+				r.result <- response[T]{err: broker.ErrSubNotFound}
+			}
+		} else {
+			r.result <- response[T]{err: broker.ErrTopicNotFound}
+		}
+
+	case TXN_PUBLISH:
+		sh.handleTxn(r, now)
+
+	case PING:
+		r.result <- response[T]{}
+
+	case REQUEUE_MSG:
+		if t, found := sh.lookup(r.key, now); found {
+			t.lastActive = now
+
+			if t.HasSubscriber(r.subscriber) {
+				t.requeue(r.subscriber, r.msg)
+				t.wakeWaiters(now)
+				r.result <- response[T]{}
+			} else {
+				r.result <- response[T]{err: broker.ErrSubNotFound}
+			}
+		} else {
+			r.result <- response[T]{err: broker.ErrTopicNotFound}
+		}
+	}
+}
+
+// index of the shard owning the topic
+func (e *Engine[T]) shardOf(topic string) int {
+	if len(e.shards) == 1 {
+		return 0
+	}
+
+	return int(e.hash(topic) % uint32(len(e.shards)))
+}
+
+// queue a request for the shard owning the topic, fails once the engine is closed
+func (e *Engine[T]) send(r *request[T]) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return broker.ErrClosed
+	}
+
+	e.queue(r)
+
+	return nil
+}
+
+// queue a request for the shard owning the topic, e.mu must be read locked
+func (e *Engine[T]) queue(r *request[T]) {
+	r.result = make(chan response[T], 1)
+	e.shards[e.shardOf(r.key)] <- r
+}
+
+// queue a publish and forward the messages the topic stored. Close waits for the forwarding
+// to be over before closing the event queues, so it is not lost.
+func (e *Engine[T]) post(r *request[T]) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return broker.ErrClosed
+	}
+
+	e.queue(r)
+	resp := <-r.result
+
+	if resp.err != nil {
+		return resp.err
+	}
+
+	e.forward(r.key, resp.msgs)
+
+	return nil
+}
+
+// queue a request for the shard owning the topic and wait for its response
+func (e *Engine[T]) call(r *request[T]) response[T] {
+	if err := e.send(r); err != nil {
+		return response[T]{err: err}
+	}
+
+	return <-r.result
+}
+
+// subscribe to topics
+func (e *Engine[T]) Subscribe(topicName, subscriberName string) error {
+	return e.call(&request[T]{action: ADD_SUB, key: topicName, subscriber: subscriberName}).err
+}
+
+// Unsubscribe to topics
+func (e *Engine[T]) UnSubscribe(topicName, subscriberName string) error {
+	return e.call(&request[T]{action: DEL_SUB, key: topicName, subscriber: subscriberName}).err
+}
+
+// publish a message to a topic
+func (e *Engine[T]) Publish(topicName string, msg *broker.Message[T]) error {
+	if err := e.chain.publish(topicName, []*broker.Message[T]{msg}); err != nil {
+		return err
+	}
+
+	if err := validPriorities(msg); err != nil {
+		return err
+	}
+
+	if err := e.chain.validate(topicName, []*broker.Message[T]{msg}); err != nil {
+		return err
+	}
+
+	return e.post(&request[T]{action: POST_MSG, key: topicName, msg: msg})
+}
+
+// pull the next message for the topic
+func (e *Engine[T]) Get(topicName, subscriberName string) (*broker.Message[T], error) {
+	r := e.call(&request[T]{action: GET_MSG, key: topicName, subscriber: subscriberName})
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return e.chain.deliver(topicName, subscriberName, r.msg), nil
+}
+
+// publish several messages to a topic in a single request. With the Reject overflow
+// policy either all of them are published or none (ErrQueueFull).
+func (e *Engine[T]) PublishBatch(topicName string, msgs []*broker.Message[T]) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	if err := e.chain.publish(topicName, msgs); err != nil {
+		return err
+	}
+
+	if err := validPriorities(msgs...); err != nil {
+		return err
+	}
+
+	if err := e.chain.validate(topicName, msgs); err != nil {
+		return err
+	}
+
+	return e.post(&request[T]{action: POST_BATCH, key: topicName, msgs: msgs})
+}
+
+// pull up to max messages for the topic in a single request
+func (e *Engine[T]) GetN(topicName, subscriberName string, max int) ([]*broker.Message[T], error) {
+	if max < 1 {
+		return nil, broker.ErrInvalidBatch
+	}
+
+	r := e.call(&request[T]{action: GET_BATCH, key: topicName, subscriber: subscriberName, count: max})
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	for i, msg := range r.msgs {
+		r.msgs[i] = e.chain.deliver(topicName, subscriberName, msg)
+	}
+
+	return r.msgs, nil
+}
+
+// check that the event loop of every shard answers before ctx is done. A shard stuck
+// on a request (or too far behind) makes it fail with ctx.Err().
+func (e *Engine[T]) Ping(ctx context.Context) error {
+	resp := make(chan response[T], len(e.shards))
+
+	e.mu.RLock()
+
+	if e.closed {
+		e.mu.RUnlock()
+		return broker.ErrClosed
+	}
+
+	for _, ch := range e.shards {
+		select {
+		case ch <- &request[T]{action: PING, result: resp}:
+		case <-ctx.Done():
+			e.mu.RUnlock()
+			return ctx.Err()
+		}
+	}
+
+	e.mu.RUnlock()
+
+	for range e.shards {
+		select {
+		case r := <-resp:
+			if r.err != nil {
+				return r.err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// close the engine. New requests are refused with ErrClosed right away, the ones
+// already queued are processed until ctx is done (pass a cancelled context to skip
+// draining them) and then fail with ErrClosed. Close waits for all the shards
+// to exit and returns ctx.Err() if draining was cut short. It is safe to call more than once.
+func (e *Engine[T]) Close(ctx context.Context) error {
+	e.mu.Lock()
+
+	if !e.closed {
+		e.closed = true
+		e.log.Info("closing")
+
+		for _, ch := range e.shards {
+			close(ch)
+		}
+	}
+
+	e.mu.Unlock()
+
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		e.log.Warn("draining aborted, the pending requests fail", "err", ctx.Err())
+		e.abortOnce.Do(func() { close(e.abort) })
+		<-e.done
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,98 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   This file contains unit tests for the engine package, the behaviour shared with the
+   other backends is covered by the conformance tests of broker/brokertest.
+
+   cmd to execute: "go test"
+
+*/
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nakdesai/pub-sub/broker"
+)
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// test that topics are routed to the shard picked by the hash function
+func TestShardOf(t *testing.T) {
+	e := New[string](Config{
+		Shards:        4,
+		DefaultConfig: broker.TopicConfig{MaxBacklog: 10, AutoCreate: true},
+		Hash:          func(topic string) uint32 { return uint32(len(topic)) },
+		Clock:         systemClock{},
+	})
+
+	if e.shardOf("abc") != 3 || e.shardOf("abcde") != 1 {
+		t.Errorf("Hash function not used")
+	}
+
+	e.Close(context.Background())
+
+	// a single shard needs no hash function
+	e = New[string](Config{Shards: 1, Clock: systemClock{}})
+
+	if e.shardOf("abc") != 0 {
+		t.Errorf("Topic routed to a missing shard")
+	}
+
+	e.Close(context.Background())
+}
+
+// test that the lifecycle events and the dropped messages are logged
+func TestLogging(t *testing.T) {
+	var buf bytes.Buffer
+
+	e := New[string](Config{
+		Shards:        1,
+		QueueSize:     10,
+		DefaultConfig: broker.TopicConfig{MaxBacklog: 1, Overflow: broker.DropNewest, AutoCreate: true},
+		Clock:         systemClock{},
+		Logger:        slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	})
+
+	e.Subscribe("topic", "sub1")
+	e.Publish("topic", &broker.Message[string]{Message: "kept"})
+	e.Publish("topic", &broker.Message[string]{Message: "dropped"})
+	e.DeleteTopic("topic")
+	e.Close(context.Background())
+
+	for _, want := range []string{
+		`msg="event loop started" shard=0`,
+		`msg="topic created" shard=0 topic=topic`,
+		`level=WARN msg="topic full, message dropped" shard=0 topic=topic overflow=drop_newest`,
+		`msg="topic deleted" shard=0 topic=topic`,
+		`msg=closing`,
+		`msg="event loop stopped" shard=0`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expected %s in the logs:\n%s", want, buf.String())
+		}
+	}
+}
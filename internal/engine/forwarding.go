@@ -0,0 +1,233 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   This file contains the forwarding rules. A rule copies the messages published to its source
+   topic to its destination topic, optionally filtered and transformed. The rules are applied
+   in the publish path to the messages the source topic stored (not to a duplicate or a message
+   dropped because the topic is full), before Publish returns. Forwarding is best effort: a
+   destination that does not exist or is full does not fail the publish, a forwarded message
+   refused by the Validate hooks of the destination is skipped. A rule closing a cycle
+   is refused, and a message is never forwarded twice to the same topic.
+
+*/
+
+package engine
+
+import (
+	"sort"
+
+	"github.com/nakdesai/pub-sub/broker"
+)
+
+// check if the rules, with rule added under name, form a cycle through the source of rule
+func loops[T any](rules map[string]broker.ForwardingRule[T], name string, rule broker.ForwardingRule[T]) bool {
+	next := make(map[string][]string)
+
+	for n, r := range rules {
+		if n != name {
+			next[r.Source] = append(next[r.Source], r.Destination)
+		}
+	}
+
+	// look for a path from the destination back to the source
+	seen := map[string]bool{}
+	stack := []string{rule.Destination}
+
+	for len(stack) > 0 {
+		topicName := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if topicName == rule.Source {
+			return true
+		}
+
+		if !seen[topicName] {
+			seen[topicName] = true
+			stack = append(stack, next[topicName]...)
+		}
+	}
+
+	return false
+}
+
+// add or replace a named rule forwarding the messages published to a topic to another topic
+func (e *Engine[T]) SetForwardingRule(name string, rule broker.ForwardingRule[T]) error {
+	if name == "" || rule.Source == "" || rule.Destination == "" {
+		return broker.ErrInvalidRule
+	}
+
+	e.rulesMu.Lock()
+	defer e.rulesMu.Unlock()
+
+	if loops(e.rules, name, rule) {
+		return broker.ErrForwardingLoop
+	}
+
+	e.rules[name] = rule
+	e.indexRules()
+
+	return nil
+}
+
+// delete a forwarding rule
+func (e *Engine[T]) DeleteForwardingRule(name string) error {
+	e.rulesMu.Lock()
+	defer e.rulesMu.Unlock()
+
+	if _, found := e.rules[name]; !found {
+		return broker.ErrRuleNotFound
+	}
+
+	delete(e.rules, name)
+	e.indexRules()
+
+	return nil
+}
+
+// return the forwarding rules by name
+func (e *Engine[T]) ForwardingRules() (map[string]broker.ForwardingRule[T], error) {
+	e.rulesMu.RLock()
+	defer e.rulesMu.RUnlock()
+
+	rules := make(map[string]broker.ForwardingRule[T], len(e.rules))
+
+	for name, rule := range e.rules {
+		rules[name] = rule
+	}
+
+	return rules, nil
+}
+
+// rebuild the rules by source topic, in name order
+func (e *Engine[T]) indexRules() {
+	names := make([]string, 0, len(e.rules))
+
+	for name := range e.rules {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	e.bySource = make(map[string][]broker.ForwardingRule[T])
+
+	for _, name := range names {
+		rule := e.rules[name]
+		e.bySource[rule.Source] = append(e.bySource[rule.Source], rule)
+	}
+}
+
+// a message published to a topic, origin is its index in the original publish
+type visit struct {
+	topic  string
+	origin int
+}
+
+// forward the messages stored by a topic along the rules, e.mu must be read locked
+func (e *Engine[T]) forward(topicName string, msgs []*broker.Message[T]) {
+	if len(msgs) == 0 {
+		return
+	}
+
+	origins := make([]int, len(msgs))
+	visited := make(map[visit]bool, len(msgs))
+
+	for i := range msgs {
+		origins[i] = i
+		visited[visit{topicName, i}] = true
+	}
+
+	e.forwardFrom(topicName, msgs, origins, visited)
+}
+
+// forward messages along the rules of a topic, origins are their indexes in the original
+// publish. visited is shared by the whole traversal from the original publish, so a message
+// reaching a topic by two paths is only published to it once.
+func (e *Engine[T]) forwardFrom(topicName string, msgs []*broker.Message[T], origins []int, visited map[visit]bool) {
+	e.rulesMu.RLock()
+	rules := e.bySource[topicName]
+	e.rulesMu.RUnlock()
+
+	for _, rule := range rules {
+		var out []*broker.Message[T]
+		var outOrigins []int
+
+		for i, msg := range msgs {
+			if visited[visit{rule.Destination, origins[i]}] {
+				continue
+			}
+
+			if rule.Filter != nil && !rule.Filter(msg) {
+				continue
+			}
+
+			// the destination assigns its own id. The idempotency key is scoped by the source
+			// topic, so the messages of two sources sharing a key are not taken for duplicates.
+			fwd := *msg
+			fwd.ID = 0
+
+			if fwd.IdempotencyKey != "" {
+				fwd.IdempotencyKey = topicName + "/" + fwd.IdempotencyKey
+			}
+
+			if rule.Transform != nil {
+				rule.Transform(&fwd)
+			}
+
+			if err := validPriorities(&fwd); err != nil {
+				continue
+			}
+
+			if err := e.chain.validate(rule.Destination, []*broker.Message[T]{&fwd}); err != nil {
+				e.log.Debug("forwarding skipped", "source", topicName, "destination", rule.Destination, "err", err)
+				continue
+			}
+
+			out = append(out, &fwd)
+			outOrigins = append(outOrigins, origins[i])
+		}
+
+		if len(out) == 0 {
+			continue
+		}
+
+		r := &request[T]{action: POST_BATCH, key: rule.Destination, msgs: out}
+		e.queue(r)
+		resp := <-r.result
+
+		if resp.err != nil {
+			e.log.Debug("forwarding skipped", "source", topicName, "destination", rule.Destination, "err", resp.err)
+			continue
+		}
+
+		for _, origin := range outOrigins {
+			visited[visit{rule.Destination, origin}] = true
+		}
+
+		// only the messages the destination stored go further
+		var stored []*broker.Message[T]
+		var storedOrigins []int
+
+		for i, msg := range out {
+			if len(stored) < len(resp.msgs) && resp.msgs[len(stored)] == msg {
+				stored = append(stored, msg)
+				storedOrigins = append(storedOrigins, outOrigins[i])
+			}
+		}
+
+		e.forwardFrom(rule.Destination, stored, storedOrigins, visited)
+	}
+}
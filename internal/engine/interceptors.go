@@ -0,0 +1,118 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   This file contains the interceptor chain. The publish, validation and delivery hooks run
+   on the goroutine of the caller, the store and enqueue hooks on the event loop of the shard
+   owning the topic: once the message is in the topic log, and when a subscriber reaches it.
+
+*/
+
+package engine
+
+import (
+	"sync"
+
+	"github.com/nakdesai/pub-sub/broker"
+)
+
+// the interceptors of an engine, shared with its shards
+type chain[T any] struct {
+	mu           sync.RWMutex
+	interceptors []broker.Interceptor[T]
+}
+
+// the interceptors, the slice is never modified in place
+func (c *chain[T]) get() []broker.Interceptor[T] {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.interceptors
+}
+
+// run the publish hooks on messages published to a topic
+func (c *chain[T]) publish(topicName string, msgs []*broker.Message[T]) error {
+	for _, ic := range c.get() {
+		if ic.OnPublish == nil {
+			continue
+		}
+
+		for _, msg := range msgs {
+			if err := ic.OnPublish(topicName, msg); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// run the validation hooks on messages about to be stored in a topic
+func (c *chain[T]) validate(topicName string, msgs []*broker.Message[T]) error {
+	for _, ic := range c.get() {
+		if ic.Validate == nil {
+			continue
+		}
+
+		for i, msg := range msgs {
+			if err := ic.Validate(topicName, msg); err != nil {
+				return &broker.MessageError{Topic: topicName, Index: i, Err: err}
+			}
+		}
+	}
+
+	return nil
+}
+
+// run the store hooks on a message stored in a topic
+func (c *chain[T]) store(topicName string, msg *broker.Message[T]) {
+	for _, ic := range c.get() {
+		if ic.OnStore != nil {
+			ic.OnStore(topicName, msg)
+		}
+	}
+}
+
+// run the enqueue hooks, false if the message is skipped for the subscriber
+func (c *chain[T]) enqueue(topicName, subscriberName string, msg *broker.Message[T]) bool {
+	for _, ic := range c.get() {
+		if ic.OnEnqueue != nil && !ic.OnEnqueue(topicName, subscriberName, msg) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// run the delivery hooks, it returns the message to deliver
+func (c *chain[T]) deliver(topicName, subscriberName string, msg *broker.Message[T]) *broker.Message[T] {
+	for _, ic := range c.get() {
+		if ic.OnDeliver != nil {
+			msg = ic.OnDeliver(topicName, subscriberName, msg)
+		}
+	}
+
+	return msg
+}
+
+// add interceptors at the end of the chain
+func (e *Engine[T]) Use(interceptors ...broker.Interceptor[T]) {
+	e.chain.mu.Lock()
+	defer e.chain.mu.Unlock()
+
+	ics := make([]broker.Interceptor[T], 0, len(e.chain.interceptors)+len(interceptors))
+	e.chain.interceptors = append(append(ics, e.chain.interceptors...), interceptors...)
+}
@@ -0,0 +1,209 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   This file contains the ordering keys. Within a subscription the messages sharing a key are
+   delivered one at a time in publish order: while a keyed message is in flight (delivered but
+   not acked yet) the next ones with the same key are held back, the other keys proceed. A
+   message not acked within the AckTimeout of its topic is delivered again. The messages held
+   back still count toward the backlog of the topic.
+
+*/
+
+package engine
+
+import (
+	"time"
+
+	"github.com/nakdesai/pub-sub/broker"
+)
+
+// a delivered message waiting for its ack
+type inflight[T any] struct {
+	msg      *broker.Message[T]
+	deadline time.Time // zero if the topic has no ack timeout
+	queued   bool      // requeued, it does not expire until it is delivered again
+}
+
+// delivery state of the keyed messages of a subscriber
+type ordering[T any] struct {
+	inflight map[uint64]*inflight[T]         // by message id
+	keys     map[string]uint64               // id of the message in flight, by key
+	held     map[string][]*broker.Message[T] // messages waiting for the one in flight, by key
+}
+
+// the ordering state of a subscriber, created on first use
+func (t *topicState[T]) orderingOf(sub string) *ordering[T] {
+	o := t.ordering[sub]
+
+	if o == nil {
+		o = &ordering[T]{
+			inflight: make(map[uint64]*inflight[T]),
+			keys:     make(map[string]uint64),
+			held:     make(map[string][]*broker.Message[T]),
+		}
+
+		t.ordering[sub] = o
+	}
+
+	return o
+}
+
+// the time by which a message delivered now must be acked
+func (t *topicState[T]) ackDeadline(now time.Time) time.Time {
+	if t.config.AckTimeout == 0 {
+		return time.Time{}
+	}
+
+	return now.Add(t.config.AckTimeout)
+}
+
+// assign the message its id and append it to the log, false if the topic is full
+func (t *topicState[T]) publish(msg *broker.Message[T], now time.Time) bool {
+	t.nextID++
+	msg.ID = t.nextID
+
+	if !t.Publish(msg, now) {
+		return false
+	}
+
+	t.remember(msg, now)
+
+	return true
+}
+
+// a message whose ack deadline passed, it is delivered again
+func (t *topicState[T]) expiredInflight(sub string, now time.Time) (*broker.Message[T], bool) {
+	if t.config.AckTimeout == 0 || t.ordering[sub] == nil {
+		return nil, false
+	}
+
+	for _, f := range t.ordering[sub].inflight {
+		if !f.queued && now.After(f.deadline) {
+			f.deadline = t.ackDeadline(now)
+			return f.msg, true
+		}
+	}
+
+	return nil, false
+}
+
+// next message of a subscriber: the messages to deliver again go first, then the log.
+// A keyed message whose key is in flight is held back until the one in flight is acked.
+func (t *topicState[T]) next(sub string, now time.Time) (*broker.Message[T], bool) {
+	if msg, ok := t.expiredInflight(sub, now); ok {
+		return msg, true
+	}
+
+	for len(t.requeued[sub]) > 0 {
+		msg := t.requeued[sub][0]
+
+		if len(t.requeued[sub]) == 1 {
+			delete(t.requeued, sub)
+		} else {
+			t.requeued[sub] = t.requeued[sub][1:]
+		}
+
+		if msg.Key == "" {
+			return msg, true
+		}
+
+		// a requeued keyed message is still in flight, unless it was acked meanwhile
+		if o := t.ordering[sub]; o != nil && o.inflight[msg.ID] != nil {
+			f := o.inflight[msg.ID]
+			f.queued = false
+			f.deadline = t.ackDeadline(now)
+			return msg, true
+		}
+	}
+
+	for {
+		msg, ok := t.Next(sub, now)
+
+		if ok && !t.chain.enqueue(t.name, sub, msg) {
+			continue
+		}
+
+		if !ok || msg.Key == "" {
+			return msg, ok
+		}
+
+		o := t.orderingOf(sub)
+
+		if _, busy := o.keys[msg.Key]; busy {
+			o.held[msg.Key] = append(o.held[msg.Key], msg)
+			t.hold(sub)
+			continue
+		}
+
+		o.keys[msg.Key] = msg.ID
+		o.inflight[msg.ID] = &inflight[T]{msg: msg, deadline: t.ackDeadline(now)}
+
+		return msg, true
+	}
+}
+
+// give a message back to deliver it again, a keyed one stays in flight but does not expire
+// meanwhile (it would be delivered twice)
+func (t *topicState[T]) requeue(sub string, msg *broker.Message[T]) {
+	if o := t.ordering[sub]; o != nil {
+		if f, found := o.inflight[msg.ID]; found {
+			f.queued = true
+		}
+	}
+
+	t.requeued[sub] = append(t.requeued[sub], msg)
+}
+
+// acknowledge a keyed message, the next message with the same key becomes deliverable
+func (t *topicState[T]) ack(sub string, id uint64, now time.Time) error {
+	o := t.ordering[sub]
+
+	if o == nil || o.inflight[id] == nil {
+		return broker.ErrMessageNotFound
+	}
+
+	key := o.inflight[id].msg.Key
+
+	delete(o.inflight, id)
+	delete(o.keys, key)
+
+	if held := o.held[key]; len(held) > 0 {
+		msg := held[0]
+
+		if len(held) == 1 {
+			delete(o.held, key)
+		} else {
+			o.held[key] = held[1:]
+		}
+
+		t.release(sub)
+
+		// it is older than the messages left in the log
+		o.keys[key] = msg.ID
+		o.inflight[msg.ID] = &inflight[T]{msg: msg}
+		t.requeue(sub, msg)
+		t.wakeWaiters(now)
+	}
+
+	return nil
+}
+
+// acknowledge a message with an ordering key, it is needed to deliver the next message with
+// the same key. It fails with ErrMessageNotFound if the message is not in flight.
+func (e *Engine[T]) Ack(topicName, subscriberName string, id uint64) error {
+	return e.call(&request[T]{action: ACK_MSG, key: topicName, subscriber: subscriberName, id: id}).err
+}
@@ -0,0 +1,275 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   This file contains the message priorities. A topic keeps a log per priority level (created
+   on the first message of that level) and delivers the highest priority first, in publish
+   order within a level. So the low priorities are not starved, after STARVATION_LIMIT
+   deliveries in a row that skipped an older message the oldest pending message is delivered.
+   The backlog and the overflow policy of the topic apply to the messages of all the levels,
+   and to the keyed messages held back by the ordering (see ordering.go).
+
+*/
+
+package engine
+
+import (
+	"math"
+	"time"
+
+	"github.com/nakdesai/pub-sub/broker"
+	"github.com/nakdesai/pub-sub/internal/topic"
+)
+
+// deliveries in a row that may skip an older message of a lower priority
+const STARVATION_LIMIT = 10
+
+// the message logs of a topic, one per priority level
+type levels[T any] struct {
+	config topic.Config
+	logs   [broker.MAX_PRIORITY + 1]*topic.Topic[*broker.Message[T]]
+	subs   map[string]int // deliveries in a row that skipped an older message, by subscriber
+	held   map[string]int // keyed messages taken out of the logs but held back, by subscriber
+	nHeld  int            // sum of held
+}
+
+func newLevels[T any](config topic.Config) *levels[T] {
+	return &levels[T]{
+		config: config,
+		subs:   make(map[string]int),
+		held:   make(map[string]int),
+	}
+}
+
+// change the settings of the logs, see topic.Reconfigure. It returns the number of unread
+// messages dropped.
+func (l *levels[T]) Reconfigure(config topic.Config) int {
+	l.config = config
+	lost := 0
+
+	for _, log := range l.logs {
+		if log != nil {
+			lost += log.Reconfigure(config)
+		}
+	}
+
+	// the backlog is shared by the levels
+	for l.Room() < 0 && l.dropOldest() {
+		lost++
+	}
+
+	return lost
+}
+
+// add a subscriber, it will only see messages published from now on
+func (l *levels[T]) Subscribe(name string) {
+	l.subs[name] = 0
+
+	for _, log := range l.logs {
+		if log != nil {
+			log.Subscribe(name)
+		}
+	}
+}
+
+// remove a subscriber, returns false if it was not subscribed
+func (l *levels[T]) Unsubscribe(name string) bool {
+	if _, found := l.subs[name]; !found {
+		return false
+	}
+
+	delete(l.subs, name)
+	l.nHeld -= l.held[name]
+	delete(l.held, name)
+
+	for _, log := range l.logs {
+		if log != nil {
+			log.Unsubscribe(name)
+		}
+	}
+
+	return true
+}
+
+// check if name is subscribed to the topic
+func (l *levels[T]) HasSubscriber(name string) bool {
+	_, found := l.subs[name]
+	return found
+}
+
+// append a message to the log of its priority, returns false if it was discarded. When
+// the backlog is full the overflow policy decides whether the oldest message of any level
+// is dropped or the new message is discarded.
+func (l *levels[T]) Publish(msg *broker.Message[T], now time.Time) bool {
+	// nobody would ever read it
+	if len(l.subs) == 0 {
+		return true
+	}
+
+	for l.full() {
+		if l.config.Overflow == topic.DropNewest || !l.dropOldest() {
+			return false
+		}
+	}
+
+	log := l.logs[msg.Priority]
+
+	if log == nil {
+		// the current subscribers see the messages of the new level
+		log = topic.New[*broker.Message[T]](l.config)
+
+		for name := range l.subs {
+			log.Subscribe(name)
+		}
+
+		l.logs[msg.Priority] = log
+	}
+
+	return log.Publish(msg, now)
+}
+
+// check that the messages can be published without discarding any
+func (l *levels[T]) Fits(msgs []*broker.Message[T]) bool {
+	return len(msgs) <= l.Room()
+}
+
+// a message of the subscriber taken out of the logs is held back, it still counts
+func (l *levels[T]) hold(name string) {
+	l.held[name]++
+	l.nHeld++
+}
+
+// a held message of the subscriber is delivered
+func (l *levels[T]) release(name string) {
+	if l.held[name]--; l.held[name] == 0 {
+		delete(l.held, name)
+	}
+
+	l.nHeld--
+}
+
+// number of messages that can be published before the backlog is full: the messages
+// of all the levels not read yet by the subscriber the furthest behind count, along
+// with the ones held back for it
+func (l *levels[T]) Room() int {
+	if len(l.subs) == 0 {
+		return math.MaxInt
+	}
+
+	pending := 0
+
+	for name := range l.subs {
+		n := l.held[name]
+
+		for _, log := range l.logs {
+			if log != nil {
+				n += log.Pending(name)
+			}
+		}
+
+		pending = max(pending, n)
+	}
+
+	return l.config.Backlog - pending
+}
+
+// check if the backlog is full, the subscribers are only scanned when the logs look full
+func (l *levels[T]) full() bool {
+	stored := l.nHeld
+
+	for _, log := range l.logs {
+		if log != nil {
+			stored += log.Len()
+		}
+	}
+
+	return stored >= l.config.Backlog && l.Room() <= 0
+}
+
+// drop the oldest message not read yet by some subscriber, across the levels. It returns
+// false if there is none.
+func (l *levels[T]) dropOldest() bool {
+	var oldest *topic.Topic[*broker.Message[T]]
+	var oldestID uint64
+
+	for _, log := range l.logs {
+		if log == nil {
+			continue
+		}
+
+		if msg, ok := log.Oldest(); ok && (oldest == nil || msg.ID < oldestID) {
+			oldest, oldestID = log, msg.ID
+		}
+	}
+
+	return oldest != nil && oldest.DropOldest()
+}
+
+// return the next message for the subscriber, the highest priority first
+func (l *levels[T]) Next(name string, now time.Time) (*broker.Message[T], bool) {
+	if !l.HasSubscriber(name) {
+		return nil, false
+	}
+
+	pick, oldest := -1, -1
+	var oldestID uint64
+
+	for p := broker.MAX_PRIORITY; p >= 0; p-- {
+		if l.logs[p] == nil {
+			continue
+		}
+
+		msg, ok := l.logs[p].Peek(name, now)
+
+		if !ok {
+			continue
+		}
+
+		if pick < 0 {
+			pick = p
+		}
+
+		if oldest < 0 || msg.ID < oldestID {
+			oldest, oldestID = p, msg.ID
+		}
+	}
+
+	if pick < 0 {
+		return nil, false
+	}
+
+	if oldest == pick {
+		l.subs[name] = 0
+	} else if l.subs[name] >= STARVATION_LIMIT {
+		pick = oldest
+		l.subs[name] = 0
+	} else {
+		l.subs[name]++
+	}
+
+	return l.logs[pick].Next(name, now)
+}
+
+// check that the priorities of the messages are in range
+func validPriorities[T any](msgs ...*broker.Message[T]) error {
+	for _, msg := range msgs {
+		if msg.Priority < 0 || msg.Priority > broker.MAX_PRIORITY {
+			return broker.ErrInvalidPriority
+		}
+	}
+
+	return nil
+}
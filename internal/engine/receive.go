@@ -0,0 +1,171 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   This file contains the blocking receive API. A Receive that finds no message is parked in
+   its topic (a waiter) and answered by the shard as soon as a message is published, so the
+   callers do not have to poll Get. Cancelling a Receive removes its waiter through the
+   event loop, a message handed to the waiter in the meantime is returned rather than lost.
+
+*/
+
+package engine
+
+import (
+	"context"
+	"time"
+
+	"github.com/nakdesai/pub-sub/broker"
+)
+
+// park a Receive until a message is published
+func (t *topicState[T]) addWaiter(r *request[T]) {
+	t.waiters[r.subscriber] = append(t.waiters[r.subscriber], r)
+}
+
+// remove a parked Receive, it is a no-op if it has already been answered
+func (t *topicState[T]) removeWaiter(w *request[T]) {
+	ws := t.waiters[w.subscriber]
+
+	for i, r := range ws {
+		if r == w {
+			ws = append(ws[:i], ws[i+1:]...)
+			break
+		}
+	}
+
+	if len(ws) == 0 {
+		delete(t.waiters, w.subscriber)
+	} else {
+		t.waiters[w.subscriber] = ws
+	}
+}
+
+// hand the new messages to the parked Receive calls, oldest first
+func (t *topicState[T]) wakeWaiters(now time.Time) {
+	for sub, ws := range t.waiters {
+		for len(ws) > 0 {
+			msg, ok := t.next(sub, now)
+
+			if !ok {
+				break
+			}
+
+			ws[0].result <- response[T]{msg: msg}
+			ws = ws[1:]
+		}
+
+		if len(ws) == 0 {
+			delete(t.waiters, sub)
+		} else {
+			t.waiters[sub] = ws
+		}
+	}
+}
+
+// answer the parked Receive calls of a subscriber with an error
+func (t *topicState[T]) failSubscriberWaiters(sub string, err error) {
+	for _, r := range t.waiters[sub] {
+		r.result <- response[T]{err: err}
+	}
+
+	delete(t.waiters, sub)
+}
+
+// answer all the parked Receive calls with an error
+func (t *topicState[T]) failWaiters(err error) {
+	for sub := range t.waiters {
+		t.failSubscriberWaiters(sub, err)
+	}
+}
+
+// pull the next message for the topic, blocking until one is published, ctx is done or
+// the engine is closed. It fails right away if ctx is done or the topic or the subscriber does not exist.
+func (e *Engine[T]) Receive(ctx context.Context, topicName, subscriberName string) (*broker.Message[T], error) {
+	msg, err := e.receive(ctx, topicName, subscriberName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return e.chain.deliver(topicName, subscriberName, msg), nil
+}
+
+// Receive without the delivery interceptors
+func (e *Engine[T]) receive(ctx context.Context, topicName, subscriberName string) (*broker.Message[T], error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r := &request[T]{action: RECV_MSG, key: topicName, subscriber: subscriberName}
+
+	if err := e.send(r); err != nil {
+		return nil, err
+	}
+
+	var resp response[T]
+
+	select {
+	case resp = <-r.result:
+	case <-ctx.Done():
+		// once the cancel has been processed the waiter is either gone or answered.
+		// If the engine is closing the shard answers all the waiters before exiting.
+		if e.call(&request[T]{action: CANCEL_RECV, key: topicName, waiter: r}).err == broker.ErrClosed {
+			resp = <-r.result
+			break
+		}
+
+		select {
+		case resp = <-r.result:
+		default:
+			return nil, ctx.Err()
+		}
+	}
+
+	if resp.err != nil {
+		return nil, resp.err
+	}
+
+	return resp.msg, nil
+}
+
+// stream the messages of a subscriber. The channel is closed once ctx is done, the engine
+// is closed or the subscriber or its topic is removed. A message received while ctx is
+// cancelled before the consumer reads it is given back, the next receive gets it.
+func (e *Engine[T]) Messages(ctx context.Context, topicName, subscriberName string) <-chan *broker.Message[T] {
+	ch := make(chan *broker.Message[T])
+
+	go func() {
+		defer close(ch)
+
+		for {
+			msg, err := e.receive(ctx, topicName, subscriberName)
+
+			if err != nil {
+				return
+			}
+
+			select {
+			case ch <- e.chain.deliver(topicName, subscriberName, msg):
+			case <-ctx.Done():
+				e.call(&request[T]{action: REQUEUE_MSG, key: topicName, subscriber: subscriberName, msg: msg})
+				return
+			}
+		}
+	}()
+
+	return ch
+}
@@ -0,0 +1,102 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   This file contains the request/reply messaging. Request creates an ephemeral reply topic,
+   publishes the request with the name of that topic in ReplyTo and waits for a reply with the
+   same CorrelationID. The responder publishes its reply to ReplyTo, copying the CorrelationID.
+   Reply topics are deleted once the request is over and never auto created, so a late reply
+   fails with ErrTopicNotFound instead of leaving a topic behind.
+
+*/
+
+package engine
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+
+	"github.com/nakdesai/pub-sub/broker"
+)
+
+// prefix of the names of the reply topics
+const REPLY_TOPIC_PREFIX = "_reply."
+
+// the subscriber of a reply topic
+const REPLY_SUBSCRIBER = "requester"
+
+// check if a topic is the reply topic of a request
+func isReplyTopic(topicName string) bool {
+	return strings.HasPrefix(topicName, REPLY_TOPIC_PREFIX)
+}
+
+// random identifier of a request
+func newRequestID() (string, error) {
+	b := make([]byte, 8)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// publish a request to a topic and wait for its reply until ctx is done. ReplyTo is set on
+// msg, as well as CorrelationID if it is empty.
+func (e *Engine[T]) Request(ctx context.Context, topicName string, msg *broker.Message[T]) (*broker.Message[T], error) {
+	id, err := newRequestID()
+
+	if err != nil {
+		return nil, err
+	}
+
+	replyTopic := REPLY_TOPIC_PREFIX + id
+
+	if err := e.CreateTopic(replyTopic, broker.TopicConfig{}); err != nil {
+		return nil, err
+	}
+
+	defer e.DeleteTopic(replyTopic)
+
+	if err := e.Subscribe(replyTopic, REPLY_SUBSCRIBER); err != nil {
+		return nil, err
+	}
+
+	if msg.CorrelationID == "" {
+		msg.CorrelationID = id
+	}
+
+	msg.ReplyTo = replyTopic
+
+	if err := e.Publish(topicName, msg); err != nil {
+		return nil, err
+	}
+
+	// the replies to another correlation id are dropped
+	for {
+		reply, err := e.Receive(ctx, replyTopic, REPLY_SUBSCRIBER)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if reply.CorrelationID == msg.CorrelationID {
+			return reply, nil
+		}
+	}
+}
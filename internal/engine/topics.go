@@ -0,0 +1,184 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+
+   This file contains the topic lifecycle API. Topics can be created explicitly with their
+   own settings, or implicitly on first Subscribe/Publish with the default settings of the
+   engine if auto creation is allowed.
+
+*/
+
+package engine
+
+import (
+	"sort"
+	"time"
+
+	"github.com/nakdesai/pub-sub/broker"
+	"github.com/nakdesai/pub-sub/internal/topic"
+)
+
+// state of a topic owned by its shard
+type topicState[T any] struct {
+	*levels[T]
+	name       string
+	chain      *chain[T]
+	config     broker.TopicConfig
+	lastActive time.Time
+	waiters    map[string][]*request[T]        // blocked Receive calls by subscriber
+	requeued   map[string][]*broker.Message[T] // messages to deliver again by subscriber
+	ordering   map[string]*ordering[T]         // keyed messages by subscriber
+	nextID     uint64                          // id of the last published message
+	seen       map[string]seenKey              // idempotency keys within the dedup window
+}
+
+// the settings of the message logs of a topic
+func logConfig(config broker.TopicConfig) topic.Config {
+	overflow := topic.DropOldest
+
+	if config.Overflow != broker.DropOldest {
+		overflow = topic.DropNewest
+	}
+
+	return topic.Config{
+		Backlog:   config.MaxBacklog,
+		Retention: config.Retention,
+		Overflow:  overflow,
+	}
+}
+
+func newTopicState[T any](name string, config broker.TopicConfig, chain *chain[T], now time.Time) *topicState[T] {
+	return &topicState[T]{
+		levels:     newLevels[T](logConfig(config)),
+		name:       name,
+		chain:      chain,
+		config:     config,
+		lastActive: now,
+		waiters:    make(map[string][]*request[T]),
+		requeued:   make(map[string][]*broker.Message[T]),
+		ordering:   make(map[string]*ordering[T]),
+		seen:       make(map[string]seenKey),
+	}
+}
+
+// change the settings of the topic, keeping its messages and subscribers. It returns the
+// number of unread messages dropped because the backlog shrank.
+func (t *topicState[T]) reconfigure(config broker.TopicConfig) int {
+	t.config = config
+	return t.Reconfigure(logConfig(config))
+}
+
+// check if the topic has been idle for longer than its TTL, blocked receivers keep it alive
+func (t *topicState[T]) expired(now time.Time) bool {
+	return t.config.TTL > 0 && len(t.waiters) == 0 && now.Sub(t.lastActive) > t.config.TTL
+}
+
+// fill in the defaults and validate a topic config
+func (e *Engine[T]) resolveConfig(config broker.TopicConfig) (broker.TopicConfig, error) {
+	if config.MaxBacklog == 0 {
+		config.MaxBacklog = e.defaultConfig.MaxBacklog
+	}
+
+	if config.DedupWindow == 0 {
+		config.DedupWindow = e.defaultConfig.DedupWindow
+	}
+
+	if config.DedupWindow < 0 {
+		config.DedupWindow = broker.NO_DEDUP
+	}
+
+	if config.MaxBacklog < 0 || config.Retention < 0 || config.TTL < 0 || config.AckTimeout < 0 ||
+		config.Overflow < broker.DropOldest || config.Overflow > broker.Reject {
+		return config, broker.ErrInvalidTopicConfig
+	}
+
+	return config, nil
+}
+
+// create a topic with its own settings
+func (e *Engine[T]) CreateTopic(topicName string, config broker.TopicConfig) error {
+	config, err := e.resolveConfig(config)
+
+	if err != nil {
+		return err
+	}
+
+	return e.call(&request[T]{action: ADD_TOPIC, key: topicName, config: config}).err
+}
+
+// change the settings of a topic, its subscribers and messages are kept. If the backlog
+// shrinks below the messages not read yet the oldest ones are dropped.
+func (e *Engine[T]) SetTopicConfig(topicName string, config broker.TopicConfig) error {
+	config, err := e.resolveConfig(config)
+
+	if err != nil {
+		return err
+	}
+
+	return e.call(&request[T]{action: SET_TOPIC, key: topicName, config: config}).err
+}
+
+// delete a topic along with its subscribers and pending messages
+func (e *Engine[T]) DeleteTopic(topicName string) error {
+	return e.call(&request[T]{action: DEL_TOPIC, key: topicName}).err
+}
+
+// list the names of the existing topics in alphabetical order
+func (e *Engine[T]) ListTopics() ([]string, error) {
+	resp := make(chan response[T], len(e.shards))
+
+	e.mu.RLock()
+
+	if e.closed {
+		e.mu.RUnlock()
+		return nil, broker.ErrClosed
+	}
+
+	// every shard owns a part of the topic key space
+	for _, ch := range e.shards {
+		ch <- &request[T]{action: LIST_TOPICS, result: resp}
+	}
+
+	e.mu.RUnlock()
+
+	var names []string
+
+	for range e.shards {
+		r := <-resp
+
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		names = append(names, r.topics...)
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// return the settings of a topic
+func (e *Engine[T]) GetTopicConfig(topicName string) (broker.TopicConfig, error) {
+	r := e.call(&request[T]{action: GET_TOPIC, key: topicName})
+
+	if r.err != nil {
+		return broker.TopicConfig{}, r.err
+	}
+
+	return r.config, nil
+}
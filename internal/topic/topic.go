@@ -0,0 +1,302 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   The topic package implements the message log of a single topic. Every published
+   message is stored once in a ring buffer shared by all the subscribers of the topic,
+   and each subscriber only holds a cursor (the sequence number of the next message it
+   will read). Publishing is O(1) regardless of the number of subscribers and the memory
+   used by a topic is bounded by its backlog, not by backlog x subscribers.
+
+   A Topic is not safe for concurrent use, it is owned by a single event loop goroutine.
+
+*/
+
+package topic
+
+import (
+	"math"
+	"time"
+)
+
+// what happens when a message is published to a full log
+type Overflow int
+
+const (
+	// overwrite the oldest message, subscribers that did not read it yet lose it
+	DropOldest Overflow = iota
+	// discard the new message until the slowest subscriber catches up
+	DropNewest
+)
+
+// topic settings
+type Config struct {
+	Backlog   int           // maximum number of messages retained in the log
+	Retention time.Duration // messages older than this are skipped, 0 keeps them until overwritten
+	Overflow  Overflow
+}
+
+// a message in the log
+type entry[M any] struct {
+	msg       M
+	published time.Time
+}
+
+// Topic is the shared message log of a topic and the cursors of its subscribers
+type Topic[M any] struct {
+	config Config
+	buf    []entry[M]
+	head   uint64 // sequence number of the oldest message still in the log
+	tail   uint64 // sequence number of the next message to be published
+	subs   map[string]uint64
+}
+
+// Instantiate a new topic
+func New[M any](config Config) *Topic[M] {
+	return &Topic[M]{
+		config: config,
+		subs:   make(map[string]uint64),
+	}
+}
+
+// return the topic settings
+func (t *Topic[M]) Config() Config {
+	return t.config
+}
+
+// change the topic settings, the messages and the cursors are kept. If the backlog shrinks
+// below the number of messages in the log the oldest ones are dropped, it returns how many
+// of them some subscriber had not read yet.
+func (t *Topic[M]) Reconfigure(config Config) int {
+	backlog, old := uint64(config.Backlog), uint64(t.config.Backlog)
+	head := t.head
+
+	if t.tail-head > backlog {
+		head = t.tail - backlog
+	}
+
+	lost := 0
+
+	if min := t.minCursor(); head > min {
+		lost = int(head - min)
+	}
+
+	// the entries keep their sequence numbers, the buffer grows up to the backlog as on publish
+	var buf []entry[M]
+
+	if backlog > 0 {
+		buf = make([]entry[M], min(t.tail, backlog))
+
+		for seq := head; seq < t.tail; seq++ {
+			buf[seq%backlog] = t.buf[seq%old]
+		}
+	}
+
+	t.config, t.buf, t.head = config, buf, head
+
+	return lost
+}
+
+// add a subscriber, it will only see messages published from now on
+func (t *Topic[M]) Subscribe(name string) {
+	t.subs[name] = t.tail
+}
+
+// remove a subscriber, returns false if it was not subscribed
+func (t *Topic[M]) Unsubscribe(name string) bool {
+	if _, found := t.subs[name]; !found {
+		return false
+	}
+
+	delete(t.subs, name)
+	return true
+}
+
+// check if name is subscribed to the topic
+func (t *Topic[M]) HasSubscriber(name string) bool {
+	_, found := t.subs[name]
+	return found
+}
+
+// number of subscribers of the topic
+func (t *Topic[M]) Subscribers() int {
+	return len(t.subs)
+}
+
+// append a message to the log, returns false if the message was discarded because the
+// log is full. The overflow policy decides whether the oldest message is overwritten (a
+// subscriber that lags more than the backlog behind loses it) or the new message is discarded.
+func (t *Topic[M]) Publish(msg M, now time.Time) bool {
+	backlog := uint64(t.config.Backlog)
+
+	// nobody would ever read it
+	if len(t.subs) == 0 {
+		return true
+	}
+
+	if backlog == 0 {
+		return false
+	}
+
+	if t.tail-t.head == backlog && t.config.Overflow == DropNewest {
+		// only scan the cursors when the log looks full, messages read by
+		// every subscriber can be reclaimed
+		t.head = t.minCursor()
+
+		if t.tail-t.head == backlog {
+			return false
+		}
+	}
+
+	// the buffer grows up to the backlog and then wraps around
+	e := entry[M]{msg, now}
+
+	if t.tail < backlog {
+		t.buf = append(t.buf, e)
+	} else {
+		t.buf[t.tail%backlog] = e
+	}
+
+	t.tail++
+
+	if t.tail-t.head > backlog {
+		t.head = t.tail - backlog
+	}
+
+	return true
+}
+
+// move the cursor of the subscriber to its next message, skipping the overwritten
+// messages and the ones past their retention. ok is false if there is none.
+func (t *Topic[M]) seek(name string, now time.Time) (cursor uint64, ok bool) {
+	cursor, found := t.subs[name]
+
+	if !found {
+		return 0, false
+	}
+
+	// the subscriber was lapped, skip to the oldest retained message
+	if cursor < t.head {
+		cursor = t.head
+	}
+
+	// skip the messages past their retention
+	for ; cursor < t.tail; cursor++ {
+		e := t.buf[cursor%uint64(t.config.Backlog)]
+
+		if t.config.Retention == 0 || now.Sub(e.published) <= t.config.Retention {
+			t.subs[name] = cursor
+			return cursor, true
+		}
+	}
+
+	t.subs[name] = cursor
+	return cursor, false
+}
+
+// return the next message for the subscriber and advance its cursor.
+// ok is false if the subscriber has no new messages (or is not subscribed).
+func (t *Topic[M]) Next(name string, now time.Time) (msg M, ok bool) {
+	cursor, ok := t.seek(name, now)
+
+	if !ok {
+		return msg, false
+	}
+
+	t.subs[name] = cursor + 1
+	return t.buf[cursor%uint64(t.config.Backlog)].msg, true
+}
+
+// return the next message for the subscriber without consuming it
+func (t *Topic[M]) Peek(name string, now time.Time) (msg M, ok bool) {
+	cursor, ok := t.seek(name, now)
+
+	if !ok {
+		return msg, false
+	}
+
+	return t.buf[cursor%uint64(t.config.Backlog)].msg, true
+}
+
+// number of messages the subscriber has not read yet
+func (t *Topic[M]) Pending(name string) int {
+	cursor, found := t.subs[name]
+
+	if !found {
+		return 0
+	}
+
+	if cursor < t.head {
+		cursor = t.head
+	}
+
+	return int(t.tail - cursor)
+}
+
+// number of messages in the log, the ones read by every subscriber included
+func (t *Topic[M]) Len() int {
+	return int(t.tail - t.head)
+}
+
+// return the oldest message some subscriber has not read yet, the messages read by every
+// subscriber are reclaimed. ok is false if every message has been read.
+func (t *Topic[M]) Oldest() (msg M, ok bool) {
+	t.head = t.minCursor()
+
+	if t.head == t.tail {
+		return msg, false
+	}
+
+	return t.buf[t.head%uint64(t.config.Backlog)].msg, true
+}
+
+// discard the oldest message some subscriber has not read yet, the subscribers that did
+// not read it lose it. It returns false if every message has been read.
+func (t *Topic[M]) DropOldest() bool {
+	if _, ok := t.Oldest(); !ok {
+		return false
+	}
+
+	t.head++
+	return true
+}
+
+// number of messages that can be published before the log is full, the messages
+// read by every subscriber do not count
+func (t *Topic[M]) Room() int {
+	if len(t.subs) == 0 {
+		return math.MaxInt
+	}
+
+	return t.config.Backlog - int(t.tail-t.minCursor())
+}
+
+// the cursor of the slowest subscriber
+func (t *Topic[M]) minCursor() uint64 {
+	min := t.tail
+
+	for _, cursor := range t.subs {
+		if cursor < min {
+			min = cursor
+		}
+	}
+
+	if min < t.head {
+		min = t.head
+	}
+
+	return min
+}
@@ -0,0 +1,455 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   This file contains unit tests and benchmarks for the topic package.
+   The benchmarks compare the shared log against the previous design where every
+   subscriber had its own buffered channel holding a copy of each message.
+
+   cmd to execute: "go test -bench=. -benchmem"
+
+*/
+
+package topic
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"testing"
+	"time"
+)
+
+var now = time.Now()
+
+// test that every subscriber reads every message in order
+func TestPublishNext(t *testing.T) {
+	tp := New[int](Config{Backlog: 10})
+	tp.Subscribe("sub1")
+	tp.Subscribe("sub2")
+
+	for i := 0; i < 3; i++ {
+		tp.Publish(i, now)
+	}
+
+	for _, sub := range []string{"sub1", "sub2"} {
+		for i := 0; i < 3; i++ {
+			msg, ok := tp.Next(sub, now)
+
+			if !ok || msg != i {
+				t.Errorf("%s: expected message %d, got %v", sub, i, msg)
+			}
+		}
+
+		if _, ok := tp.Next(sub, now); ok {
+			t.Errorf("%s: log should be empty", sub)
+		}
+	}
+}
+
+// test that a new subscriber only gets messages published after it subscribed
+func TestSubscribeFromTail(t *testing.T) {
+	tp := New[string](Config{Backlog: 10})
+	tp.Subscribe("sub1")
+	tp.Publish("old", now)
+
+	tp.Subscribe("sub2")
+	tp.Publish("new", now)
+
+	if msg, ok := tp.Next("sub2", now); !ok || msg != "new" {
+		t.Errorf("new subscriber got %v instead of the new message", msg)
+	}
+
+	if tp.Pending("sub1") != 2 {
+		t.Errorf("old subscriber should have 2 pending messages")
+	}
+}
+
+// test that a lagging subscriber skips the overwritten messages
+func TestOverwriteOldest(t *testing.T) {
+	tp := New[int](Config{Backlog: 3})
+	tp.Subscribe("slow")
+	tp.Subscribe("fast")
+
+	for i := 0; i < 5; i++ {
+		tp.Publish(i, now)
+
+		if msg, _ := tp.Next("fast", now); msg != i {
+			t.Errorf("fast subscriber expected %d, got %v", i, msg)
+		}
+	}
+
+	if tp.Pending("slow") != 3 {
+		t.Errorf("slow subscriber should have 3 pending messages, has %d", tp.Pending("slow"))
+	}
+
+	for i := 2; i < 5; i++ {
+		if msg, ok := tp.Next("slow", now); !ok || msg != i {
+			t.Errorf("slow subscriber expected %d, got %v", i, msg)
+		}
+	}
+}
+
+// test that with DropNewest the log keeps the unread messages and discards the new ones
+func TestOverflowDropNewest(t *testing.T) {
+	tp := New[int](Config{Backlog: 2, Overflow: DropNewest})
+	tp.Subscribe("slow")
+	tp.Subscribe("fast")
+
+	for i := 0; i < 3; i++ {
+		if tp.Publish(i, now) != (i < 2) {
+			t.Errorf("unexpected result publishing message %d", i)
+		}
+
+		tp.Next("fast", now)
+	}
+
+	// the slow subscriber reading a message frees a slot
+	if msg, _ := tp.Next("slow", now); msg != 0 {
+		t.Errorf("slow subscriber expected 0, got %v", msg)
+	}
+
+	if !tp.Publish(3, now) {
+		t.Errorf("message dropped although the log has room")
+	}
+
+	if msg, _ := tp.Next("fast", now); msg != 3 {
+		t.Errorf("fast subscriber expected 3, got %v", msg)
+	}
+}
+
+// test that messages past the retention are not delivered
+func TestRetention(t *testing.T) {
+	tp := New[string](Config{Backlog: 10, Retention: time.Minute})
+	tp.Subscribe("sub1")
+
+	tp.Publish("old", now)
+	tp.Publish("new", now.Add(time.Minute))
+
+	if msg, ok := tp.Next("sub1", now.Add(90*time.Second)); !ok || msg != "new" {
+		t.Errorf("expected the message within retention, got %v", msg)
+	}
+
+	if _, ok := tp.Next("sub1", now.Add(time.Hour)); ok {
+		t.Errorf("expired message delivered")
+	}
+}
+
+// test that Peek does not consume the message
+func TestPeek(t *testing.T) {
+	tp := New[int](Config{Backlog: 3})
+	tp.Subscribe("sub1")
+
+	if _, ok := tp.Peek("sub1", now); ok {
+		t.Errorf("peeked a message from an empty log")
+	}
+
+	tp.Publish(1, now)
+	tp.Publish(2, now)
+
+	for i := 0; i < 2; i++ {
+		if msg, ok := tp.Peek("sub1", now); !ok || msg != 1 {
+			t.Errorf("expected to peek 1, got %v", msg)
+		}
+	}
+
+	tp.Next("sub1", now)
+
+	if msg, ok := tp.Peek("sub1", now); !ok || msg != 2 {
+		t.Errorf("expected to peek 2, got %v", msg)
+	}
+}
+
+// test unsubscribe
+func TestUnsubscribe(t *testing.T) {
+	tp := New[int](Config{Backlog: 3})
+	tp.Subscribe("sub1")
+
+	if !tp.Unsubscribe("sub1") {
+		t.Errorf("Unsubscribe did not find the subscriber")
+	}
+
+	if tp.Unsubscribe("sub1") || tp.HasSubscriber("sub1") {
+		t.Errorf("subscriber still present after Unsubscribe")
+	}
+
+	if _, ok := tp.Next("sub1", now); ok {
+		t.Errorf("unsubscribed subscriber got a message")
+	}
+}
+
+// test the room left in the log
+func TestRoom(t *testing.T) {
+	tp := New[int](Config{Backlog: 3, Overflow: DropNewest})
+
+	if tp.Room() != math.MaxInt {
+		t.Errorf("a topic without subscribers should have unlimited room")
+	}
+
+	tp.Subscribe("slow")
+	tp.Subscribe("fast")
+
+	tp.Publish(1, now)
+	tp.Publish(2, now)
+
+	if tp.Room() != 1 {
+		t.Errorf("expected room for 1 message, got %d", tp.Room())
+	}
+
+	// only the messages read by every subscriber are freed
+	tp.Next("fast", now)
+	tp.Next("fast", now)
+
+	if tp.Room() != 1 {
+		t.Errorf("expected room for 1 message, got %d", tp.Room())
+	}
+
+	tp.Next("slow", now)
+
+	if tp.Room() != 2 {
+		t.Errorf("expected room for 2 messages, got %d", tp.Room())
+	}
+}
+
+// test that the oldest unread message is dropped, the read ones are reclaimed first
+func TestDropOldest(t *testing.T) {
+	tp := New[int](Config{Backlog: 3})
+	tp.Subscribe("slow")
+	tp.Subscribe("fast")
+
+	tp.Publish(1, now)
+	tp.Publish(2, now)
+	tp.Publish(3, now)
+
+	tp.Next("slow", now)
+	tp.Next("fast", now)
+	tp.Next("fast", now)
+
+	if msg, ok := tp.Oldest(); !ok || msg != 2 || tp.Len() != 2 {
+		t.Errorf("expected oldest message 2 out of 2, got %v out of %d", msg, tp.Len())
+	}
+
+	if !tp.DropOldest() || tp.Pending("slow") != 1 || tp.Pending("fast") != 1 {
+		t.Errorf("expected 1 pending message each, got %d and %d", tp.Pending("slow"), tp.Pending("fast"))
+	}
+
+	if msg, _ := tp.Next("slow", now); msg != 3 {
+		t.Errorf("slow subscriber expected 3, got %v", msg)
+	}
+
+	tp.Next("fast", now)
+
+	if tp.DropOldest() {
+		t.Errorf("a message read by every subscriber dropped")
+	}
+}
+
+// test that a reconfigured topic keeps its messages and cursors
+func TestReconfigure(t *testing.T) {
+	tp := New[int](Config{Backlog: 4})
+	tp.Subscribe("slow")
+	tp.Subscribe("fast")
+
+	for i := 0; i < 6; i++ {
+		tp.Publish(i, now)
+	}
+
+	tp.Next("fast", now)
+
+	// growing keeps every message, the new room is used before wrapping around
+	if lost := tp.Reconfigure(Config{Backlog: 6}); lost != 0 {
+		t.Errorf("no message should be lost, %d were", lost)
+	}
+
+	for i := 6; i < 8; i++ {
+		tp.Publish(i, now)
+	}
+
+	if tp.Pending("slow") != 6 || tp.Pending("fast") != 5 {
+		t.Errorf("expected 6 and 5 pending messages, got %d and %d", tp.Pending("slow"), tp.Pending("fast"))
+	}
+
+	if msg, _ := tp.Next("fast", now); msg != 3 {
+		t.Errorf("fast subscriber expected 3, got %v", msg)
+	}
+
+	// shrinking drops the oldest messages
+	if lost := tp.Reconfigure(Config{Backlog: 3, Overflow: DropNewest}); lost != 3 {
+		t.Errorf("expected 3 messages lost, got %d", lost)
+	}
+
+	for i := 5; i < 8; i++ {
+		for _, sub := range []string{"slow", "fast"} {
+			if msg, ok := tp.Next(sub, now); !ok || msg != i {
+				t.Errorf("%s subscriber expected %d, got %v", sub, i, msg)
+			}
+		}
+	}
+
+	// the new overflow policy applies
+	tp.Publish(8, now)
+	tp.Publish(9, now)
+	tp.Publish(10, now)
+
+	if tp.Publish(11, now) {
+		t.Errorf("message published to a full log with DropNewest")
+	}
+
+	// a log reconfigured before it wrapped around keeps growing
+	tp = New[int](Config{Backlog: 10})
+	tp.Subscribe("sub")
+	tp.Publish(0, now)
+	tp.Publish(1, now)
+	tp.Reconfigure(Config{Backlog: 3})
+
+	for i := 2; i < 5; i++ {
+		tp.Publish(i, now)
+	}
+
+	for i := 2; i < 5; i++ {
+		if msg, ok := tp.Next("sub", now); !ok || msg != i {
+			t.Errorf("expected %d, got %v", i, msg)
+		}
+	}
+
+	if tp.Reconfigure(Config{Backlog: 0}) != 0 || tp.Pending("sub") != 0 {
+		t.Errorf("empty backlog should not hold messages")
+	}
+}
+
+const (
+	benchSubscribers = 10000
+	benchBacklog     = 50
+)
+
+// the previous design: one buffered channel per subscriber, publish copies to all of them
+type chanTopic map[string]chan interface{}
+
+func newChanTopic(subs, backlog int) chanTopic {
+	ct := make(chanTopic)
+
+	for i := 0; i < subs; i++ {
+		ct[fmt.Sprintf("sub%d", i)] = make(chan interface{}, backlog)
+	}
+
+	return ct
+}
+
+func (ct chanTopic) publish(msg interface{}) {
+	for _, ch := range ct {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+func newLogTopic(subs, backlog int) *Topic[*struct{}] {
+	tp := New[*struct{}](Config{Backlog: backlog})
+
+	for i := 0; i < subs; i++ {
+		tp.Subscribe(fmt.Sprintf("sub%d", i))
+	}
+
+	return tp
+}
+
+// report the heap used by the topic built by setup, per subscriber
+func reportMemory(b *testing.B, setup func() interface{}) {
+	var before, after runtime.MemStats
+
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	v := setup()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(v)
+
+	b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/benchSubscribers, "heap-B/sub")
+}
+
+// publish to a topic with 10k subscribers, previous design
+func BenchmarkFanOutChannels(b *testing.B) {
+	ct := newChanTopic(benchSubscribers, benchBacklog)
+	msg := &struct{}{}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ct.publish(msg)
+	}
+	b.StopTimer()
+
+	reportMemory(b, func() interface{} {
+		ct := newChanTopic(benchSubscribers, benchBacklog)
+
+		for i := 0; i < benchBacklog; i++ {
+			ct.publish(msg)
+		}
+
+		return ct
+	})
+}
+
+// publish to a topic with 10k subscribers, shared log
+func BenchmarkFanOutLog(b *testing.B) {
+	tp := newLogTopic(benchSubscribers, benchBacklog)
+	msg := &struct{}{}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tp.Publish(msg, now)
+	}
+	b.StopTimer()
+
+	reportMemory(b, func() interface{} {
+		tp := newLogTopic(benchSubscribers, benchBacklog)
+
+		for i := 0; i < benchBacklog; i++ {
+			tp.Publish(msg, now)
+		}
+
+		return tp
+	})
+}
+
+// publish a message and have all the 10k subscribers read it, previous design
+func BenchmarkFanOutDeliverChannels(b *testing.B) {
+	ct := newChanTopic(benchSubscribers, benchBacklog)
+	msg := &struct{}{}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ct.publish(msg)
+
+		for _, ch := range ct {
+			<-ch
+		}
+	}
+}
+
+// publish a message and have all the 10k subscribers read it, shared log
+func BenchmarkFanOutDeliverLog(b *testing.B) {
+	tp := newLogTopic(benchSubscribers, benchBacklog)
+	msg := &struct{}{}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tp.Publish(msg, now)
+
+		for sub := range tp.subs {
+			tp.Next(sub, now)
+		}
+	}
+}
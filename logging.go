@@ -0,0 +1,139 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   Structured logging of the PubSub server (log/slog). Every HTTP call is logged once
+   handled with its request id (taken from the X-Request-Id header or generated, and echoed
+   back), topic, subscriber, status and latency. The broker logs its lifecycle events, the
+   dropped messages and the errors through the same logger.
+
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// header carrying the id of a request
+const REQUEST_ID_HEADER = "X-Request-Id"
+
+// key of the request logger in the request context
+type loggerKey struct{}
+
+// minimum level of the server logs, it can change on reload
+var logLevel slog.LevelVar
+
+// parse a log level: debug, info, warn or error
+func parseLevel(level string) (slog.Level, error) {
+	var l slog.Level
+
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return l, fmt.Errorf("invalid log level %q, expected debug, info, warn or error", level)
+	}
+
+	return l, nil
+}
+
+// create a logger writing to w the logs of level and above in format (text or json)
+func newLogger(w io.Writer, level slog.Leveler, format string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch strings.ToLower(format) {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+
+	return nil, fmt.Errorf("invalid log format %q, expected text or json", format)
+}
+
+// generate the id of a request that has none
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// the logger of a request, tagged with its id
+func requestLogger(r *http.Request) *slog.Logger {
+	if l, ok := r.Context().Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+
+	return logger
+}
+
+// records the status written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// log an http call once it has been handled
+func logged(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		start := time.Now()
+		id := r.Header.Get(REQUEST_ID_HEADER)
+
+		if id == "" {
+			id = newRequestID()
+		}
+
+		w.Header().Set(REQUEST_ID_HEADER, id)
+
+		l := logger.With("request_id", id)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		h(rec, r.WithContext(context.WithValue(r.Context(), loggerKey{}, l)), params)
+
+		attrs := []slog.Attr{slog.String("method", r.Method), slog.String("path", r.URL.Path)}
+
+		if topicName := params.ByName("topic_name"); topicName != "" {
+			attrs = append(attrs, slog.String("topic", topicName))
+		}
+
+		if subscriberName := params.ByName("subscriber_name"); subscriberName != "" {
+			attrs = append(attrs, slog.String("subscriber", subscriberName))
+		}
+
+		attrs = append(attrs, slog.Int("status", rec.status), slog.Duration("latency", time.Since(start)))
+
+		level := slog.LevelInfo
+
+		if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+
+		l.LogAttrs(r.Context(), level, "http request", attrs...)
+	}
+}
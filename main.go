@@ -19,126 +19,586 @@
 
    $ pubsub -h
    Usage of pubsub:
+   -backend string
+    	broker implementation: scalable (one topic manager per CPU) or single (one event loop) (default "scalable")
+   -config string
+    	json config file, the environment variables and the flags override its settings (see config.go)
    -ip string
     	ip address (default "127.0.0.1")
+   -log-format string
+    	log format: text or json (default "text")
+   -log-level string
+    	minimum level of the logs: debug, info, warn or error (default "info")
    -port int
     	server port to listen on (default 3000)
+   -print-config
+    	print the settings (tokens redacted) and exit
+   -redact string
+    	comma separated fields of the json messages redacted on delivery
+   -rules string
+    	json file of forwarding rules by name
+   -shutdown-timeout duration
+    	how long the requests in flight have to finish on SIGINT or SIGTERM (default 15s)
+   -trace string
+    	export the message spans as json lines to stdout or to a file
 
     Example:
     $ pubsub -port=6000
 
+    SIGINT and SIGTERM shut the server down gracefully (see shutdown.go), SIGHUP reloads
+    the settings (see reload.go).
+
 */
 
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
-	// "github.com/nakdesai/pub-sub/pubsub"
-	pubsub "github.com/nakdesai/pub-sub/pubsubScalable"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
+	"github.com/nakdesai/pub-sub/broker"
+	"github.com/nakdesai/pub-sub/pubsub"
+	"github.com/nakdesai/pub-sub/pubsubScalable"
+	"github.com/nakdesai/pub-sub/tracing"
+
 	"github.com/julienschmidt/httprouter"
 )
 
 // Maximum number of outstanding messages not pulled by the subscriber
 const MAX_OUTSTANDING_MESSAGES int = 50
 
-type PubSubInterface interface {
-	Subscribe(topicName, subscriberName string)
-	UnSubscribe(topicName, subscriberName string)
-	Publish(topicName string, msg *pubsub.PubMessage)
-	Get(topicName, subscriberName string) (*pubsub.PubMessage, error)
-}
+// how long a request waits for its reply when no timeout is given
+const DEFAULT_REQUEST_TIMEOUT = time.Second * 30
 
 var (
-	pb PubSubInterface
+	pb broker.Broker[string]
+
+	// the server logger, set up from -log-level and -log-format
+	logger = slog.Default()
+
+	// records the spans of the messages, nil unless enabled by -trace
+	tracer *tracing.Tracer
 )
 
-// publish a message on a topic
+// create the broker implementation selected by the Backend setting, the config is assumed to be valid
+func newBroker(c serverConfig) (broker.Broker[string], error) {
+	dedupWindow, _ := parseDuration(c.DefaultDedupWindow)
+
+	switch c.Backend {
+	case "scalable":
+		opts := []pubsubScalable.Option{
+			pubsubScalable.WithDefaultBacklog(c.DefaultBacklog),
+			pubsubScalable.WithDefaultDedupWindow(dedupWindow),
+			pubsubScalable.WithAutoCreate(c.AutoCreate),
+			pubsubScalable.WithLogger(logger),
+		}
+
+		if c.Workers > 0 {
+			opts = append(opts, pubsubScalable.WithWorkers(c.Workers))
+		}
+
+		if c.QueueSize > 0 {
+			opts = append(opts, pubsubScalable.WithQueueSize(c.QueueSize))
+		}
+
+		return pubsubScalable.New[string](opts...)
+	case "single":
+		opts := []pubsub.Option{
+			pubsub.WithDefaultBacklog(c.DefaultBacklog),
+			pubsub.WithDefaultDedupWindow(dedupWindow),
+			pubsub.WithAutoCreate(c.AutoCreate),
+			pubsub.WithLogger(logger),
+		}
+
+		if c.QueueSize > 0 {
+			opts = append(opts, pubsub.WithQueueSize(c.QueueSize))
+		}
+
+		return pubsub.New[string](opts...)
+	}
+
+	return nil, fmt.Errorf("unknown backend %q, expected scalable or single", c.Backend)
+}
+
+// create the tracer exporting to the -trace destination
+func newTracer(to string) (*tracing.Tracer, error) {
+	if to == "stdout" {
+		return tracing.NewTracer(tracing.NewWriterExporter(os.Stdout)), nil
+	}
+
+	f, err := os.OpenFile(to, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return tracing.NewTracer(tracing.NewWriterExporter(f)), nil
+}
+
+// the topic names taken by the health and admin endpoints, no topic can have them
+var reservedTopics = map[string]bool{"admin": true, "healthz": true, "readyz": true}
+
+// map a pubsub error to an http status code
+func errorStatus(err error) int {
+	var invalid *broker.MessageError
+
+	if errors.As(err, &invalid) {
+		return http.StatusUnprocessableEntity
+	}
+
+	switch err {
+	case broker.ErrSubNotFound, broker.ErrTopicNotFound, broker.ErrMessageNotFound, broker.ErrRuleNotFound:
+		return http.StatusNotFound
+	case broker.ErrNoNewMessages:
+		return http.StatusNoContent
+	case broker.ErrSubscriberExists, broker.ErrTopicExists, broker.ErrForwardingLoop:
+		return http.StatusConflict
+	case broker.ErrInvalidTopicConfig, broker.ErrInvalidBatch, broker.ErrInvalidPriority, broker.ErrInvalidRule:
+		return http.StatusBadRequest
+	case broker.ErrQueueFull:
+		return http.StatusTooManyRequests
+	case broker.ErrRejected:
+		return http.StatusForbidden
+	case broker.ErrClosed:
+		return http.StatusServiceUnavailable
+	case context.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusInternalServerError
+}
+
+// set the trace context of the messages published by a request that have none: the
+// traceparent header, or the publish span if tracing is enabled. It returns the function
+// ending the span once the messages are published.
+func traceMessages(r *http.Request, topicName string, msgs ...*broker.PubMessage) (end func()) {
+	traceparent := r.Header.Get("traceparent")
+
+	if _, err := tracing.ParseTraceParent(traceparent); err != nil {
+		traceparent = ""
+	}
+
+	var span *tracing.Span
+
+	if tracer != nil {
+		span = tracer.Start(tracing.PUBLISH, traceparent, topicName, "", 0)
+		traceparent = span.TraceParent()
+	}
+
+	for _, msg := range msgs {
+		if msg.TraceParent == "" {
+			msg.TraceParent = traceparent
+		}
+	}
+
+	return func() {
+		if span != nil {
+			tracer.End(span)
+		}
+	}
+}
+
+// publish a message on a topic, or a request with ?request
 func publish(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if reservedTopics[params.ByName("topic_name")] {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if r.URL.Query().Has("request") {
+		request(w, r, params)
+		return
+	}
+
 	// validate that the body of the POST request is json
-	if r.Header["Content-Type"][0] != "application/json" {
-		log.Println("Content-Type is not JSON")
+	if r.Header.Get("Content-Type") != "application/json" {
+		requestLogger(r).Warn("Content-Type is not JSON", "content_type", r.Header.Get("Content-Type"))
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
 	decoder := json.NewDecoder(r.Body)
-	var req pubsub.PubMessage
+	var body json.RawMessage
 
-	if err := decoder.Decode(&req); err != nil {
+	if err := decoder.Decode(&body); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	req.Published = time.Now()
-	pb.Publish(params.ByName("topic_name"), &req)
+	var err error
+
+	// a json array is a batch of messages published in a single request
+	if bytes.HasPrefix(body, []byte("[")) {
+		var req []*broker.PubMessage
+
+		if err := json.Unmarshal(body, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		for _, msg := range req {
+			if msg == nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		end := traceMessages(r, params.ByName("topic_name"), req...)
+		err = pb.PublishBatch(params.ByName("topic_name"), req)
+		end()
+	} else {
+		var req broker.PubMessage
+
+		if err := json.Unmarshal(body, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if req.IdempotencyKey == "" {
+			req.IdempotencyKey = r.Header.Get("Idempotency-Key")
+		}
+
+		end := traceMessages(r, params.ByName("topic_name"), &req)
+		err = pb.Publish(params.ByName("topic_name"), &req)
+		end()
+
+		// a retried publish gets the id of the original message
+		if err == nil {
+			w.Header().Set("Message-Id", strconv.FormatUint(req.ID, 10))
+		}
+	}
+
+	if err != nil {
+		publishFailed(w, err)
+		return
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 	return
 }
 
+// publish messages to several topics atomically, the body maps topic names to arrays of messages
+func publishAtomic(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if r.Header.Get("Content-Type") != "application/json" {
+		requestLogger(r).Warn("Content-Type is not JSON", "content_type", r.Header.Get("Content-Type"))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var req map[string][]*broker.PubMessage
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	for topicName, msgs := range req {
+		if reservedTopics[topicName] {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		for _, msg := range msgs {
+			if msg == nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	var all []*broker.PubMessage
+
+	for _, msgs := range req {
+		all = append(all, msgs...)
+	}
+
+	end := traceMessages(r, "", all...)
+	err := pb.PublishAtomic(req)
+	end()
+
+	if err != nil {
+		publishFailed(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // subscribe to a topic
 func subscribe(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	pb.Subscribe(params.ByName("topic_name"), params.ByName("subscriber_name"))
+	if reservedTopics[params.ByName("topic_name")] {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := pb.Subscribe(params.ByName("topic_name"), params.ByName("subscriber_name")); err != nil {
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+
 	w.WriteHeader(http.StatusCreated)
 	return
 }
 
+// publish a request to a topic and wait for its reply, until ?timeout= (e.g. "5s")
+func request(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	timeout, _ := parseDuration(currentConfig().Limits.RequestTimeout)
+
+	if s := r.URL.Query().Get("timeout"); s != "" {
+		var err error
+
+		if timeout, err = time.ParseDuration(s); err != nil || timeout <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	var req broker.PubMessage
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	end := traceMessages(r, params.ByName("topic_name"), &req)
+	reply, err := pb.Request(ctx, params.ByName("topic_name"), &req)
+	end()
+
+	if err != nil {
+		publishFailed(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
 // Unsubscribe to a topic
 func unsubscribe(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	pb.UnSubscribe(params.ByName("topic_name"), params.ByName("subscriber_name"))
+	if err := pb.UnSubscribe(params.ByName("topic_name"), params.ByName("subscriber_name")); err != nil {
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 	return
 }
 
-// Pull a message for a topic
+// Pull a message for a topic, or an array of up to ?max=N messages
 func getMsg(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	msg, err := pb.Get(params.ByName("topic_name"), params.ByName("subscriber_name"))
+	var resp interface{}
+	var msgs []*broker.PubMessage
+	var err error
+
+	topicName, subscriberName := params.ByName("topic_name"), params.ByName("subscriber_name")
+
+	if max := r.URL.Query().Get("max"); max != "" {
+		n, convErr := strconv.Atoi(max)
+
+		if convErr != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		msgs, err = pb.GetN(topicName, subscriberName, n)
+		resp = msgs
+	} else {
+		var msg *broker.PubMessage
+
+		if msg, err = pb.Get(topicName, subscriberName); err == nil {
+			msgs, resp = []*broker.PubMessage{msg}, msg
+
+			if msg.TraceParent != "" {
+				w.Header().Set("traceparent", msg.TraceParent)
+			}
+		}
+	}
+
+	pulled := time.Now()
 
 	// set the content-type to json
 	w.Header().Set("Content-Type", "application/json")
 
 	if err != nil {
-		if err == pubsub.ErrSubNotFound || err == pubsub.ErrTopicNotFound {
-			w.WriteHeader(http.StatusNotFound)
-		} else if err == pubsub.ErrNoNewMessages {
-			w.WriteHeader(http.StatusNoContent)
-		}
+		w.WriteHeader(errorStatus(err))
 		return
 	}
 
 	encoder := json.NewEncoder(w)
 
-	if err := encoder.Encode(*msg); err != nil {
+	if err := encoder.Encode(resp); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if tracer != nil {
+		for _, msg := range msgs {
+			tracer.Record(tracing.DELIVER, msg.TraceParent, topicName, subscriberName, msg.ID, pulled)
+		}
 	}
 
 	return
 }
 
-func main() {
+// acknowledge a message with an ordering key
+func ack(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id, err := strconv.ParseUint(params.ByName("message_id"), 10, 64)
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-	var port int
-	var ip string
+	if err := pb.Ack(params.ByName("topic_name"), params.ByName("subscriber_name"), id); err != nil {
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	flag.IntVar(&port, "port", 3000, "server port to listen on")
-	flag.StringVar(&ip, "ip", "127.0.0.1", "ip address")
+func main() {
+	c := defaultConfig()
+
+	// the flags are bound to a copy, only the ones given override the config file and the environment
+	flags := c
+
+	var configFile string
+	var printConfig bool
+	var rulesFile string
+	var redact string
+
+	flag.StringVar(&configFile, "config", os.Getenv("PUBSUB_CONFIG"), "json config file, the environment variables and the flags override its settings (see config.go)")
+	flag.BoolVar(&printConfig, "print-config", false, "print the settings (tokens redacted) and exit")
+	flag.IntVar(&flags.Port, "port", c.Port, "server port to listen on")
+	flag.StringVar(&flags.IP, "ip", c.IP, "ip address")
+	flag.StringVar(&flags.Backend, "backend", c.Backend, "broker implementation: scalable (one topic manager per CPU) or single (one event loop)")
+	flag.BoolVar(&flags.AutoCreate, "auto-create", c.AutoCreate, "create the topics that do not exist on subscribe and publish")
+	flag.StringVar(&rulesFile, "rules", "", "json file of forwarding rules by name")
+	flag.StringVar(&redact, "redact", "", "comma separated fields of the json messages redacted on delivery")
+	flag.StringVar(&flags.Trace, "trace", "", "export the message spans as json lines to stdout or to a file")
+	flag.StringVar(&flags.Log.Level, "log-level", c.Log.Level, "minimum level of the logs: debug, info, warn or error")
+	flag.StringVar(&flags.Log.Format, "log-format", c.Log.Format, "log format: text or json")
+	flag.StringVar(&flags.Limits.ShutdownTimeout, "shutdown-timeout", c.Limits.ShutdownTimeout, "how long the requests in flight have to finish on SIGINT or SIGTERM")
 
 	flag.Parse()
 
-	pb = pubsub.NewPubSub(MAX_OUTSTANDING_MESSAGES)
+	source = configSource{file: configFile, flags: flags, set: make(map[string]bool), redact: redact}
+	flag.Visit(func(f *flag.Flag) { source.set[f.Name] = true })
+
+	c, err := source.load()
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config:\n%v\n", err)
+		os.Exit(2)
+	}
+
+	if printConfig {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		enc.Encode(c.redacted())
+		return
+	}
+
+	level, _ := parseLevel(c.Log.Level)
+	logLevel.Set(level)
+	logger, _ = newLogger(os.Stderr, &logLevel, c.Log.Format)
+
+	// fail logging the error
+	fatal := func(msg string, err error) {
+		logger.Error(msg, "err", err)
+		os.Exit(1)
+	}
+
+	if pb, err = newBroker(c); err != nil {
+		fatal("creating the broker", err)
+	}
+
+	// the messages are stamped with the server time on publish and checked against the schemas
+	pb.Use(broker.Timestamp[string](time.Now), validateSchemas())
+
+	if len(c.Redact) > 0 {
+		pb.Use(broker.RedactJSON(c.Redact...))
+	}
+
+	if c.Trace != "" {
+		if tracer, err = newTracer(c.Trace); err != nil {
+			fatal("creating the tracer", err)
+		}
+
+		pb.Use(tracing.Interceptor[string](tracer))
+	}
+
+	if _, errs := applyTopics(&serverConfig{}, &c); len(errs) > 0 {
+		fatal("creating the topics", errors.Join(errs...))
+	}
+
+	if _, errs := applyRules(&serverConfig{}, &c); len(errs) > 0 {
+		fatal("setting the forwarding rules", errors.Join(errs...))
+	}
+
+	if rulesFile != "" {
+		if err := loadRules(rulesFile); err != nil {
+			fatal("loading the forwarding rules", err)
+		}
+	}
+
+	settings.Store(&c)
 
 	router := httprouter.New()
-	router.POST("/:topic_name", publish)
-	router.POST("/:topic_name/:subscriber_name", subscribe)
-	router.DELETE("/:topic_name/:subscriber_name", unsubscribe)
-	router.GET("/:topic_name/:subscriber_name", getMsg)
+	router.POST("/", logged(publishAtomic))
+	router.POST("/:topic_name", logged(publish))
+	router.POST("/:topic_name/:subscriber_name", logged(subscribe))
+	router.DELETE("/:topic_name/:subscriber_name", logged(unsubscribe))
+	router.GET("/:topic_name/:subscriber_name", logged(getMsg))
+	router.POST("/:topic_name/:subscriber_name/ack/:message_id", logged(ack))
+
+	// the admin endpoints cannot share the router with the /:topic_name wildcard
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", authorize(limitBody(newAdminRouter())))
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", readyz)
+	mux.Handle("/", authorize(limitBody(router)))
+
+	addr := fmt.Sprintf("%s:%d", c.IP, c.Port)
+	ln, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		fatal("listening", err)
+	}
 
-	addr := fmt.Sprintf("%s:%d", ip, port)
-	log.Fatal(http.ListenAndServe(addr, router))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
+	// SIGHUP reloads the settings
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			reload()
+		}
+	}()
+
+	logger.Info("listening", "addr", addr, "backend", c.Backend)
+
+	if err := serve(ctx, &http.Server{Handler: mux}, ln); err != nil {
+		fatal("serving", err)
+	}
 }
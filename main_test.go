@@ -21,32 +21,189 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
-	"pubsub"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/nakdesai/pub-sub/broker"
+	"github.com/nakdesai/pub-sub/pubsub"
+	"github.com/nakdesai/pub-sub/schema"
+	"github.com/nakdesai/pub-sub/tracing"
+
 	"github.com/julienschmidt/httprouter"
 )
 
-// mock the PubSub type by implementing the PubSubInterface interface
-type mockPB struct{}
+// mock the PubSub type by implementing the broker.Broker interface
+type mockPB struct {
+	published *broker.PubMessage // the last message published
+	pingErr   error              // returned by Ping
+	closed    bool
+}
+
+func (m *mockPB) Subscribe(topicName, subscriberName string) error {
+	if subscriberName == "existing" {
+		return broker.ErrSubscriberExists
+	}
+
+	return nil
+}
+
+func (m *mockPB) UnSubscribe(topicName, subscriberName string) error {
+	if subscriberName == "missing" {
+		return broker.ErrSubNotFound
+	}
+
+	return nil
+}
+
+func (m *mockPB) Publish(topicName string, msg *broker.PubMessage) error {
+	if topicName == "full" {
+		return broker.ErrQueueFull
+	}
+
+	m.published = msg
+
+	// a retry gets the id of the original message
+	if msg.IdempotencyKey == "retry" {
+		msg.ID = 1
+	} else {
+		msg.ID = 2
+	}
+
+	return nil
+}
+
+func (m *mockPB) Get(topicName, subscriberName string) (*broker.PubMessage, error) {
+	if topicName == "traced" {
+		return &broker.PubMessage{Message: "msg", Published: time.Now(), TraceParent: TRACEPARENT, ID: 1}, nil
+	}
 
-func (m *mockPB) Subscribe(topicName, subscriberName string) {
-	return
+	return &broker.PubMessage{Message: "msg", Published: time.Now()}, nil
 }
 
-func (m *mockPB) UnSubscribe(topicName, subscriberName string) {
-	return
+func (m *mockPB) PublishBatch(topicName string, msgs []*broker.PubMessage) error {
+	if topicName == "full" {
+		return broker.ErrQueueFull
+	}
+
+	return nil
 }
 
-func (m *mockPB) Publish(topicName string, msg *pubsub.PubMessage) {
-	return
+func (m *mockPB) PublishAtomic(batches map[string][]*broker.PubMessage) error {
+	if _, found := batches["full"]; found {
+		return broker.ErrQueueFull
+	}
+
+	return nil
 }
 
-func (m *mockPB) Get(topicName, subscriberName string) (*pubsub.PubMessage, error) {
-	return &pubsub.PubMessage{Message: "msg", Published: time.Now()}, nil
+func (m *mockPB) Ack(topicName, subscriberName string, id uint64) error {
+	if id != 1 {
+		return broker.ErrMessageNotFound
+	}
+
+	return nil
+}
+
+func (m *mockPB) GetN(topicName, subscriberName string, max int) ([]*broker.PubMessage, error) {
+	if max < 1 {
+		return nil, broker.ErrInvalidBatch
+	}
+
+	msgs := make([]*broker.PubMessage, max)
+
+	for i := range msgs {
+		msgs[i] = &broker.PubMessage{Message: "msg", Published: time.Now()}
+	}
+
+	return msgs, nil
+}
+
+func (m *mockPB) Request(ctx context.Context, topicName string, msg *broker.PubMessage) (*broker.PubMessage, error) {
+	if topicName == "silent" {
+		return nil, context.DeadlineExceeded
+	}
+
+	return &broker.PubMessage{Message: "reply", Published: time.Now(), CorrelationID: msg.CorrelationID}, nil
+}
+
+func (m *mockPB) SetForwardingRule(name string, rule broker.ForwardingRule[string]) error {
+	if name == "loop" {
+		return broker.ErrForwardingLoop
+	}
+
+	return nil
+}
+
+func (m *mockPB) DeleteForwardingRule(name string) error {
+	if name == "missing" {
+		return broker.ErrRuleNotFound
+	}
+
+	return nil
+}
+
+func (m *mockPB) ForwardingRules() (map[string]broker.ForwardingRule[string], error) {
+	return nil, nil
+}
+
+func (m *mockPB) Use(interceptors ...broker.Interceptor[string]) {
+}
+
+func (m *mockPB) Receive(ctx context.Context, topicName, subscriberName string) (*broker.PubMessage, error) {
+	return m.Get(topicName, subscriberName)
+}
+
+func (m *mockPB) Messages(ctx context.Context, topicName, subscriberName string) <-chan *broker.PubMessage {
+	return nil
+}
+
+func (m *mockPB) Consume(topicName, subscriberName string, handler broker.Handler[string], opts broker.ConsumeOptions) (broker.Consumer, error) {
+	return nil, broker.ErrInvalidConsumeOptions
+}
+
+func (m *mockPB) CreateTopic(topicName string, config broker.TopicConfig) error {
+	if topicName == "existing" {
+		return broker.ErrTopicExists
+	}
+
+	return nil
+}
+
+func (m *mockPB) DeleteTopic(topicName string) error {
+	return broker.ErrTopicNotFound
+}
+
+func (m *mockPB) ListTopics() ([]string, error) {
+	return []string{"topic1", "topic2"}, nil
+}
+
+func (m *mockPB) Close(ctx context.Context) error {
+	m.closed = true
+	return nil
+}
+
+func (m *mockPB) SetTopicConfig(topicName string, config broker.TopicConfig) error {
+	return nil
+}
+
+func (m *mockPB) Ping(ctx context.Context) error {
+	return m.pingErr
+}
+
+func (m *mockPB) GetTopicConfig(topicName string) (broker.TopicConfig, error) {
+	return broker.TopicConfig{MaxBacklog: 10, TTL: time.Minute}, nil
 }
 
 // test subscribe
@@ -124,6 +281,1102 @@ func TestGetMsg(t *testing.T) {
 
 }
 
-// TODO
+// test publish
 func TestPublish(t *testing.T) {
+	pb = &mockPB{}
+
+	for topicName, code := range map[string]int{"topic1": http.StatusNoContent, "full": http.StatusTooManyRequests} {
+		req, _ := http.NewRequest("POST", "http://localhost:3000/"+topicName, strings.NewReader(`{"Message": "msg"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		params := []httprouter.Param{
+			{
+				Key:   "topic_name",
+				Value: topicName,
+			},
+		}
+		w := httptest.NewRecorder()
+		publish(w, req, params)
+
+		if w.Code != code {
+			t.Errorf("Incorrect http status code %d publishing to %s", w.Code, topicName)
+		}
+	}
+
+	// a request without a Content-Type is refused
+	req, _ := http.NewRequest("POST", "http://localhost:3000/topic1", strings.NewReader(`{"Message": "msg"}`))
+	w := httptest.NewRecorder()
+	logged(publish)(w, req, []httprouter.Param{{Key: "topic_name", Value: "topic1"}})
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Incorrect http status code %d publishing without a Content-Type", w.Code)
+	}
+}
+
+// test the idempotency key of a publish
+func TestPublishIdempotency(t *testing.T) {
+	pb = &mockPB{}
+
+	for _, test := range []struct {
+		body, header, id string
+	}{
+		{`{"Message": "msg"}`, "", "2"},
+		{`{"Message": "msg"}`, "retry", "1"},
+		{`{"Message": "msg", "IdempotencyKey": "retry"}`, "", "1"},
+	} {
+		req, _ := http.NewRequest("POST", "http://localhost:3000/topic1", strings.NewReader(test.body))
+		req.Header.Set("Content-Type", "application/json")
+
+		if test.header != "" {
+			req.Header.Set("Idempotency-Key", test.header)
+		}
+
+		w := httptest.NewRecorder()
+		publish(w, req, []httprouter.Param{{Key: "topic_name", Value: "topic1"}})
+
+		if w.Code != http.StatusNoContent || w.Header().Get("Message-Id") != test.id {
+			t.Errorf("publishing %s with key %q: expected id %s, got %d %q", test.body, test.header, test.id,
+				w.Code, w.Header().Get("Message-Id"))
+		}
+	}
+}
+
+// test the request/reply endpoint
+func TestRequest(t *testing.T) {
+	pb = &mockPB{}
+
+	for _, test := range []struct {
+		topic, query, body string
+		code               int
+	}{
+		{"rpc", "?request", `{"Message": "ping", "CorrelationID": "c1"}`, http.StatusOK},
+		{"rpc", "?request&timeout=5s", `{"Message": "ping", "CorrelationID": "c1"}`, http.StatusOK},
+		{"rpc", "?request&timeout=soon", `{"Message": "ping"}`, http.StatusBadRequest},
+		{"rpc", "?request", `{"Message": 1}`, http.StatusBadRequest},
+		{"silent", "?request&timeout=1ms", `{"Message": "ping"}`, http.StatusGatewayTimeout},
+	} {
+		req, _ := http.NewRequest("POST", "http://localhost:3000/"+test.topic+test.query, strings.NewReader(test.body))
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		publish(w, req, []httprouter.Param{{Key: "topic_name", Value: test.topic}})
+
+		if w.Code != test.code {
+			t.Errorf("Incorrect http status code %d for request %s%s %s", w.Code, test.topic, test.query, test.body)
+			continue
+		}
+
+		if w.Code == http.StatusOK {
+			var reply broker.PubMessage
+
+			if err := json.NewDecoder(w.Body).Decode(&reply); err != nil || reply.Message != "reply" || reply.CorrelationID != "c1" {
+				t.Errorf("Incorrect reply %+v, %v", reply, err)
+			}
+		}
+	}
+
+	// "request" is an ordinary subscriber name
+	w := httptest.NewRecorder()
+	subscribe(w, httptest.NewRequest("POST", "/rpc/request", nil),
+		[]httprouter.Param{{Key: "topic_name", Value: "rpc"}, {Key: "subscriber_name", Value: "request"}})
+
+	if w.Code != http.StatusCreated {
+		t.Errorf("Incorrect http status code %d subscribing as \"request\"", w.Code)
+	}
+}
+
+// test publishing a json array of messages
+func TestPublishBatch(t *testing.T) {
+	pb = &mockPB{}
+
+	for body, code := range map[string]int{
+		`[{"Message": "msg1"}, {"Message": "msg2"}]`: http.StatusNoContent,
+		`[{"Message": "msg1"}, null]`:                http.StatusBadRequest,
+		`[{"Message": 1}]`:                           http.StatusBadRequest,
+	} {
+		req, _ := http.NewRequest("POST", "http://localhost:3000/topic1", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		publish(w, req, []httprouter.Param{{Key: "topic_name", Value: "topic1"}})
+
+		if w.Code != code {
+			t.Errorf("Incorrect http status code %d publishing %s", w.Code, body)
+		}
+	}
+}
+
+// test publishing to several topics atomically
+func TestPublishAtomic(t *testing.T) {
+	pb = &mockPB{}
+
+	for body, code := range map[string]int{
+		`{"orders": [{"Message": "msg1"}], "audit": [{"Message": "msg2"}]}`: http.StatusNoContent,
+		`{"orders": [{"Message": "msg1"}], "full": [{"Message": "msg2"}]}`:  http.StatusTooManyRequests,
+		`{"orders": [null]}`:    http.StatusBadRequest,
+		`{"healthz": []}`:       http.StatusBadRequest,
+		`[{"Message": "msg1"}]`: http.StatusBadRequest,
+	} {
+		req, _ := http.NewRequest("POST", "http://localhost:3000/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		publishAtomic(w, req, nil)
+
+		if w.Code != code {
+			t.Errorf("Incorrect http status code %d publishing %s", w.Code, body)
+		}
+	}
+}
+
+// test getting several messages with ?max=N
+func TestGetBatch(t *testing.T) {
+	pb = &mockPB{}
+
+	params := []httprouter.Param{
+		{Key: "topic_name", Value: "topic1"},
+		{Key: "subscriber_name", Value: "sub1"},
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost:3000/topic1/sub1?max=3", nil)
+	w := httptest.NewRecorder()
+	getMsg(w, req, params)
+
+	var msgs []broker.PubMessage
+
+	if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&msgs) != nil || len(msgs) != 3 {
+		t.Errorf("Incorrect response %d getting a batch of messages", w.Code)
+	}
+
+	for max, code := range map[string]int{"0": http.StatusBadRequest, "x": http.StatusBadRequest} {
+		req, _ := http.NewRequest("GET", "http://localhost:3000/topic1/sub1?max="+max, nil)
+		w := httptest.NewRecorder()
+		getMsg(w, req, params)
+
+		if w.Code != code {
+			t.Errorf("Incorrect http status code %d for max=%s", w.Code, max)
+		}
+	}
+}
+
+// test acknowledging a message
+func TestAck(t *testing.T) {
+	pb = &mockPB{}
+
+	for id, code := range map[string]int{"1": http.StatusNoContent, "2": http.StatusNotFound, "x": http.StatusBadRequest} {
+		req, _ := http.NewRequest("POST", "http://localhost:3000/topic1/sub1/ack/"+id, nil)
+
+		params := []httprouter.Param{
+			{Key: "topic_name", Value: "topic1"},
+			{Key: "subscriber_name", Value: "sub1"},
+			{Key: "message_id", Value: id},
+		}
+		w := httptest.NewRecorder()
+		ack(w, req, params)
+
+		if w.Code != code {
+			t.Errorf("Incorrect http status code %d acking message %s", w.Code, id)
+		}
+	}
+}
+
+// test the status codes of failed operations
+func TestErrorStatus(t *testing.T) {
+	pb = &mockPB{}
+
+	params := []httprouter.Param{
+		{
+			Key:   "topic_name",
+			Value: "topic1",
+		},
+		{
+			Key:   "subscriber_name",
+			Value: "existing",
+		},
+	}
+
+	req, _ := http.NewRequest("POST", "http://localhost:3000/topic1/existing", nil)
+	w := httptest.NewRecorder()
+	subscribe(w, req, params)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("Incorrect http status code %d for a duplicate subscriber", w.Code)
+	}
+
+	params[1].Value = "missing"
+
+	req, _ = http.NewRequest("DELETE", "http://localhost:3000/topic1/missing", nil)
+	w = httptest.NewRecorder()
+	unsubscribe(w, req, params)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Incorrect http status code %d for an unknown subscriber", w.Code)
+	}
+
+	if errorStatus(broker.ErrClosed) != http.StatusServiceUnavailable {
+		t.Errorf("Incorrect http status code for a closed pubsub")
+	}
+}
+
+// test the topic admin endpoints
+func TestAdminTopics(t *testing.T) {
+	pb = &mockPB{}
+	router := newAdminRouter()
+
+	req, _ := http.NewRequest("PUT", "http://localhost:3000/admin/topics/orders",
+		strings.NewReader(`{"MaxBacklog": 10, "TTL": "1m", "Overflow": "drop_newest"}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Errorf("Incorrect http status code %d for creating a topic", w.Code)
+	}
+
+	req, _ = http.NewRequest("PUT", "http://localhost:3000/admin/topics/existing", strings.NewReader(""))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("Incorrect http status code %d for creating an existing topic", w.Code)
+	}
+
+	req, _ = http.NewRequest("PUT", "http://localhost:3000/admin/topics/orders",
+		strings.NewReader(`{"Overflow": "drop_everything"}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Incorrect http status code %d for an invalid topic config", w.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "http://localhost:3000/admin/topics/orders", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var config topicConfig
+
+	if err := json.NewDecoder(w.Body).Decode(&config); err != nil || config.TTL != "1m0s" {
+		t.Errorf("Incorrect topic config %+v, %v", config, err)
+	}
+
+	if c, err := (topicConfig{DedupWindow: "off"}).parse(); err != nil || c.DedupWindow != broker.NO_DEDUP {
+		t.Errorf("Incorrect dedup window %v for \"off\", %v", c.DedupWindow, err)
+	}
+
+	if c, err := (topicConfig{AutoCreate: true}).parse(); err != nil || !c.AutoCreate {
+		t.Errorf("AutoCreate not parsed, %v", err)
+	}
+
+	req, _ = http.NewRequest("GET", "http://localhost:3000/admin/topics", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var topics []string
+
+	if err := json.NewDecoder(w.Body).Decode(&topics); err != nil || len(topics) != 2 {
+		t.Errorf("Incorrect topic list %v, %v", topics, err)
+	}
+
+	req, _ = http.NewRequest("DELETE", "http://localhost:3000/admin/topics/orders", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Incorrect http status code %d for deleting a missing topic", w.Code)
+	}
+}
+
+// test the selection of the broker implementation
+func TestNewBroker(t *testing.T) {
+	for _, backend := range []string{"scalable", "single"} {
+		c := defaultConfig()
+		c.Backend, c.Workers, c.QueueSize = backend, 2, 10
+		b, err := newBroker(c)
+
+		if err != nil {
+			t.Errorf("Error creating %s backend: %s", backend, err)
+			continue
+		}
+
+		b.Close(context.Background())
+	}
+
+	c := defaultConfig()
+	c.Backend = "unknown"
+
+	if _, err := newBroker(c); err == nil {
+		t.Errorf("Unknown backend not flagged")
+	}
+}
+
+// test the forwarding rule admin endpoints
+func TestForwardingRules(t *testing.T) {
+	pb = &mockPB{}
+	router := newAdminRouter()
+
+	for _, test := range []struct {
+		method, name, body string
+		code               int
+	}{
+		{"PUT", "eu", `{"Source": "orders.eu", "Destination": "orders.all", "Filter": {"Contains": "paid"}}`, http.StatusNoContent},
+		{"PUT", "bad", `{"Source": "a", "Destination": "b", "Transform": {"Priority": 10}}`, http.StatusBadRequest},
+		{"PUT", "bad", `{"Source": 1}`, http.StatusBadRequest},
+		{"PUT", "loop", `{"Source": "a", "Destination": "b"}`, http.StatusConflict},
+		{"DELETE", "missing", "", http.StatusNotFound},
+	} {
+		req, _ := http.NewRequest(test.method, "http://localhost:3000/admin/rules/"+test.name, strings.NewReader(test.body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != test.code {
+			t.Errorf("Incorrect http status code %d for %s rule %s", w.Code, test.method, test.name)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost:3000/admin/rules", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var byName map[string]forwardingRule
+
+	if err := json.NewDecoder(w.Body).Decode(&byName); err != nil || len(byName) != 1 || byName["eu"].Destination != "orders.all" {
+		t.Errorf("Incorrect rules %+v, %v", byName, err)
+	}
+
+	req, _ = http.NewRequest("DELETE", "http://localhost:3000/admin/rules/eu", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent || len(rules.byName) != 0 {
+		t.Errorf("Incorrect http status code %d deleting a rule, %d rules left", w.Code, len(rules.byName))
+	}
+}
+
+// test the filter and transform of a forwarding rule
+func TestForwardingRuleCompile(t *testing.T) {
+	priority := 7
+
+	rule, err := forwardingRule{
+		Source:      "orders.eu",
+		Destination: "orders.all",
+		Filter:      &messageFilter{Key: "k", Contains: "paid", MinPriority: 2},
+		Transform:   &messageTransform{Prefix: "eu:", Priority: &priority},
+	}.compile()
+
+	if err != nil {
+		t.Fatalf("Error compiling a rule: %v", err)
+	}
+
+	for msg, want := range map[broker.PubMessage]bool{
+		{Message: "order paid", Key: "k", Priority: 2}: true,
+		{Message: "order paid", Key: "x", Priority: 2}: false,
+		{Message: "order sent", Key: "k", Priority: 2}: false,
+		{Message: "order paid", Key: "k", Priority: 1}: false,
+	} {
+		if rule.Filter(&msg) != want {
+			t.Errorf("filter of %+v: expected %v", msg, want)
+		}
+	}
+
+	msg := broker.PubMessage{Message: "order paid"}
+	rule.Transform(&msg)
+
+	if msg.Message != "eu:order paid" || msg.Priority != 7 {
+		t.Errorf("Incorrect transformed message %+v", msg)
+	}
+}
+
+// test loading the forwarding rules from a file
+func TestLoadRules(t *testing.T) {
+	pb = &mockPB{}
+	path := filepath.Join(t.TempDir(), "rules.json")
+
+	os.WriteFile(path, []byte(`{"eu": {"Source": "orders.eu", "Destination": "orders.all"}}`), 0600)
+
+	if err := loadRules(path); err != nil || rules.byName["eu"].Source != "orders.eu" {
+		t.Errorf("Error loading the rules: %v", err)
+	}
+
+	os.WriteFile(path, []byte(`{"loop": {"Source": "a", "Destination": "b"}}`), 0600)
+
+	if err := loadRules(path); err != broker.ErrForwardingLoop {
+		t.Errorf("Expected a loop error, got %v", err)
+	}
+
+	if err := loadRules(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("Missing rules file not flagged")
+	}
+
+	pb.DeleteForwardingRule("eu")
+	delete(rules.byName, "eu")
+}
+
+// test the schema admin endpoints and the validation of the published messages
+func TestSchemas(t *testing.T) {
+	b, _ := pubsub.New[string]()
+	b.Use(validateSchemas())
+	pb = b
+	schemas = schema.NewRegistry()
+	router := newAdminRouter()
+
+	defer b.Close(context.Background())
+
+	for _, test := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"GET", "/admin/schemas/orders", "", http.StatusNotFound},
+		{"PUT", "/admin/schemas/orders", `{"type": "object", "required": ["id"]}`, http.StatusCreated},
+		{"PUT", "/admin/schemas/orders", `{"type": "object"}`, http.StatusConflict},
+		{"PUT", "/admin/schemas/orders", `{"type": "text"}`, http.StatusBadRequest},
+		{"PUT", "/admin/schemas/orders", `{"type": "object", "required": ["id", "amount"]}`, http.StatusCreated},
+		{"GET", "/admin/schemas/orders/1", "", http.StatusOK},
+		{"GET", "/admin/schemas/orders/3", "", http.StatusNotFound},
+		{"GET", "/admin/schemas/orders/first", "", http.StatusBadRequest},
+	} {
+		req, _ := http.NewRequest(test.method, "http://localhost:3000"+test.path, strings.NewReader(test.body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != test.code {
+			t.Errorf("Incorrect http status code %d for %s %s %s", w.Code, test.method, test.path, test.body)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost:3000/admin/schemas/orders", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var latest schema.Version
+
+	if err := json.NewDecoder(w.Body).Decode(&latest); err != nil || latest.Version != 2 || len(latest.Schema.Required) != 2 {
+		t.Errorf("Incorrect latest schema %+v, %v", latest, err)
+	}
+
+	for body, code := range map[string]int{
+		`{"Message": "{\"id\": 1, \"amount\": 2}"}`:                        http.StatusNoContent,
+		`{"Message": "{\"id\": 1}"}`:                                       http.StatusUnprocessableEntity,
+		`[{"Message": "{\"id\": 1, \"amount\": 2}"}]`:                      http.StatusNoContent,
+		`[{"Message": "{\"id\": 1, \"amount\": 2}"}, {"Message": "oops"}]`: http.StatusUnprocessableEntity,
+	} {
+		req, _ := http.NewRequest("POST", "http://localhost:3000/orders", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		publish(w, req, []httprouter.Param{{Key: "topic_name", Value: "orders"}})
+
+		if w.Code != code {
+			t.Errorf("Incorrect http status code %d publishing %s", w.Code, body)
+		}
+	}
+
+	req, _ = http.NewRequest("POST", "http://localhost:3000/", strings.NewReader(`{"audit": [{"Message": "x"}], "orders": [{"Message": "{}"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	w = httptest.NewRecorder()
+	publishAtomic(w, req, nil)
+
+	var invalid []messageErrors
+
+	if err := json.NewDecoder(w.Body).Decode(&invalid); err != nil || w.Code != http.StatusUnprocessableEntity ||
+		len(invalid) != 1 || invalid[0].Topic != "orders" || len(invalid[0].Errors) != 2 {
+		t.Errorf("Incorrect validation errors %d %+v, %v", w.Code, invalid, err)
+	}
+
+	// the library api and the forwarded messages are validated too
+	var refused *broker.MessageError
+
+	if err := b.Publish("orders", &broker.PubMessage{Message: "oops"}); !errors.As(err, &refused) || refused.Topic != "orders" {
+		t.Errorf("Invalid message published through the library api: %v", err)
+	}
+
+	b.SetForwardingRule("copy", broker.ForwardingRule[string]{Source: "raw", Destination: "orders"})
+	b.Subscribe("orders", "sub1")
+
+	if err := b.Publish("raw", &broker.PubMessage{Message: "oops"}); err != nil {
+		t.Errorf("Error publishing to the source of a rule: %v", err)
+	}
+
+	if msg, err := b.Get("orders", "sub1"); err != broker.ErrNoNewMessages {
+		t.Errorf("Invalid message forwarded: %v, %v", msg, err)
+	}
+
+	schemas = schema.NewRegistry()
+}
+
+const TRACEPARENT = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// collects the spans
+type spanCollector struct {
+	spans []tracing.Span
+}
+
+func (c *spanCollector) Export(span tracing.Span) {
+	c.spans = append(c.spans, span)
+}
+
+// test the propagation of the trace context and the publish and deliver spans
+func TestTracing(t *testing.T) {
+	mock := &mockPB{}
+	pb = mock
+
+	publishWith := func(traceparent string) {
+		req, _ := http.NewRequest("POST", "http://localhost:3000/topic1", strings.NewReader(`{"Message": "msg"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		if traceparent != "" {
+			req.Header.Set("traceparent", traceparent)
+		}
+
+		publish(httptest.NewRecorder(), req, []httprouter.Param{{Key: "topic_name", Value: "topic1"}})
+	}
+
+	// without tracing the header is stored as is, an invalid one is dropped
+	publishWith(TRACEPARENT)
+
+	if mock.published.TraceParent != TRACEPARENT {
+		t.Errorf("expected the traceparent %s, got %q", TRACEPARENT, mock.published.TraceParent)
+	}
+
+	publishWith("00-bogus")
+
+	if mock.published.TraceParent != "" {
+		t.Errorf("invalid traceparent stored: %q", mock.published.TraceParent)
+	}
+
+	collector := &spanCollector{}
+	tracer = tracing.NewTracer(collector)
+	defer func() { tracer = nil }()
+
+	// with tracing the message carries the context of the publish span
+	publishWith(TRACEPARENT)
+
+	if len(collector.spans) != 1 {
+		t.Fatalf("expected a publish span, got %v", collector.spans)
+	}
+
+	span := collector.spans[0]
+	tp, err := tracing.ParseTraceParent(mock.published.TraceParent)
+
+	if span.Name != tracing.PUBLISH || span.ParentID != "00f067aa0ba902b7" || err != nil ||
+		tp.TraceID != span.TraceID || tp.ParentID != span.SpanID {
+		t.Errorf("Incorrect publish span %+v for the message traceparent %q", span, mock.published.TraceParent)
+	}
+
+	// a publish without a trace context starts a new trace
+	publishWith("")
+
+	if len(collector.spans) != 2 || collector.spans[1].ParentID != "" || collector.spans[1].TraceID == span.TraceID {
+		t.Errorf("Incorrect publish span of a new trace %+v", collector.spans[1:])
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost:3000/traced/sub1", nil)
+	w := httptest.NewRecorder()
+	getMsg(w, req, []httprouter.Param{{Key: "topic_name", Value: "traced"}, {Key: "subscriber_name", Value: "sub1"}})
+
+	if w.Header().Get("traceparent") != TRACEPARENT {
+		t.Errorf("expected the traceparent header %s, got %q", TRACEPARENT, w.Header().Get("traceparent"))
+	}
+
+	if len(collector.spans) != 3 || collector.spans[2].Name != tracing.DELIVER || collector.spans[2].Subscriber != "sub1" {
+		t.Errorf("Incorrect deliver span %+v", collector.spans[2:])
+	}
+}
+
+// test the log of the http calls
+func TestLogging(t *testing.T) {
+	pb = &mockPB{}
+
+	var buf bytes.Buffer
+	logger, _ = newLogger(&buf, slog.LevelInfo, "json")
+	defer func() { logger = slog.Default() }()
+
+	h := logged(subscribe)
+	params := []httprouter.Param{{Key: "topic_name", Value: "topic1"}, {Key: "subscriber_name", Value: "existing"}}
+
+	req, _ := http.NewRequest("POST", "http://localhost:3000/topic1/existing", nil)
+	req.Header.Set(REQUEST_ID_HEADER, "req-1")
+	w := httptest.NewRecorder()
+	h(w, req, params)
+
+	if w.Header().Get(REQUEST_ID_HEADER) != "req-1" {
+		t.Errorf("expected the request id req-1, got %q", w.Header().Get(REQUEST_ID_HEADER))
+	}
+
+	var entry struct {
+		Level      string
+		Msg        string
+		RequestID  string `json:"request_id"`
+		Method     string
+		Path       string
+		Topic      string
+		Subscriber string
+		Status     int
+		Latency    int64
+	}
+
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("invalid log %q: %v", buf.String(), err)
+	}
+
+	if entry.Level != "INFO" || entry.Msg != "http request" || entry.RequestID != "req-1" || entry.Method != "POST" ||
+		entry.Path != "/topic1/existing" || entry.Topic != "topic1" || entry.Subscriber != "existing" ||
+		entry.Status != http.StatusConflict {
+		t.Errorf("Incorrect log %s", buf.String())
+	}
+
+	// a request without an id gets one
+	buf.Reset()
+	req, _ = http.NewRequest("POST", "http://localhost:3000/topic1/sub1", nil)
+	w = httptest.NewRecorder()
+	h(w, req, []httprouter.Param{{Key: "topic_name", Value: "topic1"}, {Key: "subscriber_name", Value: "sub1"}})
+
+	if id := w.Header().Get(REQUEST_ID_HEADER); id == "" || !strings.Contains(buf.String(), `"request_id":"`+id+`"`) {
+		t.Errorf("request id %q not logged: %s", id, buf.String())
+	}
+
+	// the log level is raised, the info logs are dropped
+	buf.Reset()
+	logger, _ = newLogger(&buf, slog.LevelWarn, "text")
+	h(httptest.NewRecorder(), req, params)
+
+	if buf.Len() != 0 {
+		t.Errorf("unexpected log %s", buf.String())
+	}
+
+	if _, err := parseLevel("verbose"); err == nil {
+		t.Errorf("invalid log level accepted")
+	}
+
+	if _, err := newLogger(&buf, slog.LevelInfo, "xml"); err == nil {
+		t.Errorf("invalid log format accepted")
+	}
+}
+
+// test the liveness and readiness checks
+func TestHealth(t *testing.T) {
+	mock := &mockPB{}
+	pb = mock
+
+	tests := []struct {
+		pingErr error
+		healthz int
+		readyz  int
+	}{
+		{nil, http.StatusOK, http.StatusOK},
+		{broker.ErrClosed, http.StatusOK, http.StatusServiceUnavailable},
+		{context.DeadlineExceeded, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+	}
+
+	for _, test := range tests {
+		mock.pingErr = test.pingErr
+
+		for _, c := range []struct {
+			handler http.HandlerFunc
+			want    int
+		}{{healthz, test.healthz}, {readyz, test.readyz}} {
+			w := httptest.NewRecorder()
+			c.handler(w, httptest.NewRequest("GET", "/healthz", nil))
+
+			var status healthStatus
+
+			if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+				t.Fatalf("invalid health status: %v", err)
+			}
+
+			if w.Code != c.want || (status.Status == "ok") != (c.want == http.StatusOK) || status.Checks["event_loops"] == "" {
+				t.Errorf("ping error %v: expected %d, got %d %+v", test.pingErr, c.want, w.Code, status)
+			}
+		}
+	}
+}
+
+// test that a shutdown waits for the requests in flight and then closes the broker
+func TestShutdown(t *testing.T) {
+	mock := &mockPB{}
+	pb = mock
+	defer shuttingDown.Store(false)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readyz", readyz)
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(time.Millisecond * 200)
+
+		if mock.closed {
+			t.Errorf("broker closed with a request in flight")
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+
+	go func() {
+		served <- serve(ctx, &http.Server{Handler: mux}, ln)
+	}()
+
+	url := "http://" + ln.Addr().String()
+
+	if resp, err := http.Get(url + "/readyz"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("server not ready: %v", err)
+	}
+
+	slow := make(chan int, 1)
+
+	go func() {
+		resp, err := http.Get(url + "/slow")
+
+		if err != nil {
+			slow <- 0
+			return
+		}
+
+		slow <- resp.StatusCode
+	}()
+
+	<-started
+	cancel()
+
+	if code := <-slow; code != http.StatusNoContent {
+		t.Errorf("request in flight cut: %d", code)
+	}
+
+	if err := <-served; err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if !mock.closed {
+		t.Errorf("broker not closed")
+	}
+
+	// the server is no longer ready
+	w := httptest.NewRecorder()
+	readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 while shutting down, got %d", w.Code)
+	}
+
+	if _, err := http.Get(url + "/readyz"); err == nil {
+		t.Errorf("connection accepted after the shutdown")
+	}
+}
+
+// test that a request still blocked in the broker at the deadline answers 503
+func TestShutdownBlocked(t *testing.T) {
+	b, _ := pubsub.New[string]()
+	pb = b
+	defer shuttingDown.Store(false)
+
+	c := defaultConfig()
+	c.Limits.ShutdownTimeout = "50ms"
+	settings.Store(&c)
+	defer settings.Store(nil)
+
+	b.Subscribe("orders", "sub1")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/blocked", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+
+		// no message is published, it waits until the broker is closed
+		_, err := pb.Receive(r.Context(), "orders", "sub1")
+
+		// the answer is not written right away, the connection must stay open meanwhile
+		time.Sleep(time.Millisecond * 50)
+		w.WriteHeader(errorStatus(err))
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+
+	go func() {
+		served <- serve(ctx, &http.Server{Handler: mux}, ln)
+	}()
+
+	blocked := make(chan int, 1)
+
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/blocked")
+
+		if err != nil {
+			t.Errorf("blocked request cut: %v", err)
+			blocked <- 0
+			return
+		}
+
+		blocked <- resp.StatusCode
+	}()
+
+	<-started
+	cancel()
+
+	if code := <-blocked; code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 for the blocked request, got %d", code)
+	}
+
+	if err := <-served; err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+// test the config file, the environment overrides and the validation
+func TestConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"Port": 4000, "Backend": "single", "Topics": {"orders": {"MaxBacklog": 5, "TTL": "1h"}},
+		"Auth": {"Tokens": ["t1"]}, "Limits": {"RequestTimeout": "5s"}}`), 0644)
+
+	c := defaultConfig()
+
+	if err := loadConfigFile(path, &c); err != nil {
+		t.Fatalf("Error loading the config: %v", err)
+	}
+
+	env := map[string]string{"PUBSUB_PORT": "5000", "PUBSUB_ADMIN_TOKENS": "a1,a2", "PUBSUB_LOG_LEVEL": "debug", "PUBSUB_AUTO_CREATE": "false"}
+	lookup := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+
+	if err := applyEnv(&c, lookup); err != nil {
+		t.Fatalf("Error applying the environment: %v", err)
+	}
+
+	if err := c.validate(); err != nil {
+		t.Errorf("valid config refused: %v", err)
+	}
+
+	// the file overrides the defaults, the environment overrides the file
+	if c.Port != 5000 || c.Backend != "single" || c.IP != "127.0.0.1" || c.Topics["orders"].TTL != "1h" ||
+		c.Limits.RequestTimeout != "5s" || c.Limits.ShutdownTimeout != "15s" || c.Log.Level != "debug" ||
+		len(c.Auth.Tokens) != 1 || len(c.Auth.AdminTokens) != 2 || c.AutoCreate {
+		t.Errorf("Incorrect config %+v", c)
+	}
+
+	if r := c.redacted(); r.Auth.Tokens[0] != "<redacted>" || r.Auth.AdminTokens[1] != "<redacted>" || c.Auth.Tokens[0] != "t1" {
+		t.Errorf("Tokens not redacted %+v", r.Auth)
+	}
+
+	// unknown settings are refused
+	os.WriteFile(path, []byte(`{"Prot": 4000}`), 0644)
+
+	if err := loadConfigFile(path, &c); err == nil {
+		t.Errorf("unknown setting not flagged")
+	}
+
+	env = map[string]string{"PUBSUB_WORKERS": "many"}
+
+	if err := applyEnv(&c, lookup); err == nil {
+		t.Errorf("invalid environment variable not flagged")
+	}
+
+	// every problem is reported
+	c = defaultConfig()
+	c.Port = 70000
+	c.Backend = "multi"
+	c.DefaultBacklog = 0
+	c.Limits.RequestTimeout = "soon"
+	c.Topics = map[string]topicConfig{"orders": {TTL: "1 hour"}}
+	c.Rules = map[string]forwardingRule{"copy": {Source: "orders"}}
+	c.Auth.Tokens = []string{" "}
+	c.Log.Format = "xml"
+
+	err := c.validate()
+
+	for _, want := range []string{"Port", "Backend", "DefaultBacklog", "Limits.RequestTimeout", "Topics.orders", "Rules.copy", "Auth", "Log.Format"} {
+		if err == nil || !strings.Contains(err.Error(), want+":") {
+			t.Errorf("expected a %s error, got %v", want, err)
+		}
+	}
+}
+
+// test that the topic names of the health and admin endpoints are refused
+func TestReservedTopics(t *testing.T) {
+	pb = &mockPB{}
+
+	for topicName := range reservedTopics {
+		params := httprouter.Params{{Key: "topic_name", Value: topicName}, {Key: "subscriber_name", Value: "sub1"}}
+
+		for name, handler := range map[string]httprouter.Handle{"publish": publish, "subscribe": subscribe, "create": createTopic} {
+			req, _ := http.NewRequest("POST", "http://localhost:3000/"+topicName, strings.NewReader(`{"Message": "msg1"}`))
+			req.Header.Set("Content-Type", "application/json")
+
+			w := httptest.NewRecorder()
+			handler(w, req, params)
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s on %q: expected 400, got %d", name, topicName, w.Code)
+			}
+		}
+
+		if _, err := (forwardingRule{Source: "orders", Destination: topicName}).compile(); err != broker.ErrInvalidRule {
+			t.Errorf("rule to %q: expected %v, got %v", topicName, broker.ErrInvalidRule, err)
+		}
+
+		c := defaultConfig()
+		c.Topics = map[string]topicConfig{topicName: {}}
+
+		if err := c.validate(); err == nil || !strings.Contains(err.Error(), "Topics."+topicName+":") {
+			t.Errorf("config topic %q: expected an error, got %v", topicName, err)
+		}
+	}
+}
+
+// test the bearer token authentication
+func TestAuth(t *testing.T) {
+	defer settings.Store(nil)
+
+	h := authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		auth  authConfig
+		path  string
+		token string
+		want  int
+	}{
+		{authConfig{}, "/topic1/sub1", "", http.StatusNoContent},
+		{authConfig{}, "/admin/topics", "", http.StatusNoContent},
+		{authConfig{Tokens: []string{"t1"}}, "/topic1/sub1", "", http.StatusUnauthorized},
+		{authConfig{Tokens: []string{"t1"}}, "/topic1/sub1", "t2", http.StatusUnauthorized},
+		{authConfig{Tokens: []string{"t1"}}, "/topic1/sub1", "t1", http.StatusNoContent},
+		{authConfig{Tokens: []string{"t1"}}, "/admin/topics", "t1", http.StatusNoContent},
+		{authConfig{Tokens: []string{"t1"}, AdminTokens: []string{"a1"}}, "/admin/topics", "t1", http.StatusForbidden},
+		{authConfig{Tokens: []string{"t1"}, AdminTokens: []string{"a1"}}, "/admin/topics", "a1", http.StatusNoContent},
+		{authConfig{Tokens: []string{"t1"}, AdminTokens: []string{"a1"}}, "/topic1/sub1", "a1", http.StatusNoContent},
+		{authConfig{AdminTokens: []string{"a1"}}, "/topic1/sub1", "", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		c := defaultConfig()
+		c.Auth = test.auth
+		settings.Store(&c)
+
+		req := httptest.NewRequest("GET", test.path, nil)
+
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != test.want {
+			t.Errorf("%+v %s with token %q: expected %d, got %d", test.auth, test.path, test.token, test.want, w.Code)
+		}
+	}
+}
+
+// test the reload of the settings on a running broker
+func TestReload(t *testing.T) {
+	b, _ := pubsub.New[string]()
+	pb = b
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	defer func() {
+		b.Close(context.Background())
+		settings.Store(nil)
+		logLevel.Set(slog.LevelInfo)
+		rules.byName = make(map[string]forwardingRule)
+	}()
+
+	os.WriteFile(path, []byte(`{"Topics": {"orders": {"MaxBacklog": 2, "Overflow": "reject"}},
+		"Rules": {"audit": {"Source": "orders", "Destination": "audit"}}}`), 0644)
+
+	source = configSource{file: path}
+	c, err := source.load()
+
+	if err != nil {
+		t.Fatalf("Error loading the config: %v", err)
+	}
+
+	applyTopics(&serverConfig{}, &c)
+	applyRules(&serverConfig{}, &c)
+	settings.Store(&c)
+
+	b.Subscribe("orders", "sub1")
+	b.Publish("orders", &broker.PubMessage{Message: "msg1"})
+	b.Publish("orders", &broker.PubMessage{Message: "msg2"})
+
+	router := newAdminRouter()
+
+	reloadWith := func(config string) (int, reloadReport) {
+		os.WriteFile(path, []byte(config), 0644)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/reload", nil))
+
+		var report reloadReport
+		json.NewDecoder(w.Body).Decode(&report)
+
+		return w.Code, report
+	}
+
+	code, report := reloadWith(`{"Port": 4000, "Topics": {"orders": {"MaxBacklog": 3, "Overflow": "reject"}, "billing": {}},
+		"Rules": {"eu": {"Source": "orders", "Destination": "eu"}},
+		"Auth": {"Tokens": ["t1"]}, "Log": {"Level": "debug"}}`)
+
+	if code != http.StatusOK || fmt.Sprint(report.Applied) != "[Auth Log.Level Rules.audit Rules.eu Topics.billing Topics.orders]" ||
+		fmt.Sprint(report.RestartRequired) != "[Port]" || len(report.Errors) != 0 {
+		t.Errorf("Incorrect reload %d %+v", code, report)
+	}
+
+	// the queued messages are kept, the new backlog applies
+	if err := b.Publish("orders", &broker.PubMessage{Message: "msg3"}); err != nil {
+		t.Errorf("backlog not reconfigured: %v", err)
+	}
+
+	for _, want := range []string{"msg1", "msg2", "msg3"} {
+		if msg, err := b.Get("orders", "sub1"); err != nil || msg.Message != want {
+			t.Errorf("expected %s, got %v, %v", want, msg, err)
+		}
+	}
+
+	if _, err := b.GetTopicConfig("billing"); err != nil {
+		t.Errorf("topic not created: %v", err)
+	}
+
+	if rules, _ := b.ForwardingRules(); len(rules) != 1 || rules["eu"].Destination != "eu" {
+		t.Errorf("Incorrect forwarding rules %v", rules)
+	}
+
+	if c := currentConfig(); c.Port != 3000 || len(c.Auth.Tokens) != 1 || logLevel.Level() != slog.LevelDebug {
+		t.Errorf("Incorrect settings in effect %+v", c)
+	}
+
+	// an invalid config is refused as a whole
+	code, report = reloadWith(`{"Backend": "multi", "Auth": {"Tokens": ["t2"]}}`)
+
+	if code != http.StatusBadRequest || len(report.Errors) != 1 || currentConfig().Auth.Tokens[0] != "t1" {
+		t.Errorf("Incorrect reload of an invalid config %d %+v", code, report)
+	}
+
+	// a setting that cannot be applied is reported and keeps its value
+	code, report = reloadWith(`{"Topics": {"orders": {"MaxBacklog": 3, "Overflow": "reject"}, "billing": {}},
+		"Rules": {"eu": {"Source": "orders", "Destination": "eu"}, "back": {"Source": "eu", "Destination": "orders"}}}`)
+
+	if code != http.StatusConflict || len(report.Errors) != 1 || !strings.HasPrefix(report.Errors[0], "Rules.back:") {
+		t.Errorf("Incorrect reload of a forwarding loop %d %+v", code, report)
+	}
+
+	if _, found := currentConfig().Rules["back"]; found {
+		t.Errorf("rule not applied kept in the settings")
+	}
 }
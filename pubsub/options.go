@@ -0,0 +1,140 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   This file contains the options accepted by New.
+
+   pb, err := pubsub.New[string](
+       pubsub.WithQueueSize(500),
+       pubsub.WithDefaultBacklog(100),
+   )
+
+*/
+
+package pubsub
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nakdesai/pub-sub/internal/engine"
+)
+
+// source of the current time, it can be replaced in tests
+type Clock = engine.Clock
+
+// the wall clock
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// settings of a PubSub, filled in by the options
+type options struct {
+	queueSize     int
+	defaultConfig TopicConfig
+	clock         Clock
+	logger        *slog.Logger
+}
+
+// an option configures a PubSub created by New
+type Option func(*options) error
+
+// default settings
+func defaultOptions() options {
+	return options{
+		queueSize: REQUEST_QUEUE_SIZE,
+		defaultConfig: TopicConfig{
+			MaxBacklog:  MAX_OUTSTANDING_MESSAGES,
+			DedupWindow: DEDUP_WINDOW,
+			AutoCreate:  true,
+		},
+		clock: systemClock{},
+	}
+}
+
+// length of the event queue
+func WithQueueSize(n int) Option {
+	return func(o *options) error {
+		if n < 0 {
+			return fmt.Errorf("pubsub: queue size must not be negative, got %d", n)
+		}
+
+		o.queueSize = n
+		return nil
+	}
+}
+
+// backlog of the topics created without an explicit MaxBacklog
+func WithDefaultBacklog(n int) Option {
+	return func(o *options) error {
+		if n <= 0 {
+			return fmt.Errorf("pubsub: default backlog must be positive, got %d", n)
+		}
+
+		o.defaultConfig.MaxBacklog = n
+		return nil
+	}
+}
+
+// dedup window of the topics created without an explicit DedupWindow
+func WithDefaultDedupWindow(d time.Duration) Option {
+	return func(o *options) error {
+		if d < 0 {
+			return fmt.Errorf("pubsub: default dedup window must not be negative, got %v", d)
+		}
+
+		o.defaultConfig.DedupWindow = d
+		return nil
+	}
+}
+
+// create the topics that never existed on Subscribe and Publish (the default), when off
+// they fail with ErrTopicNotFound until the topic is created with CreateTopic. An expired
+// topic is created again according to its own AutoCreate.
+func WithAutoCreate(on bool) Option {
+	return func(o *options) error {
+		o.defaultConfig.AutoCreate = on
+		return nil
+	}
+}
+
+// clock used to timestamp and expire messages and topics
+func WithClock(clock Clock) Option {
+	return func(o *options) error {
+		if clock == nil {
+			return fmt.Errorf("pubsub: clock must not be nil")
+		}
+
+		o.clock = clock
+		return nil
+	}
+}
+
+// logger of the lifecycle events (topics created, deleted or expired, event loops started
+// and stopped), the dropped messages and the handler failures. By default nothing is logged.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) error {
+		if logger == nil {
+			return fmt.Errorf("pubsub: logger must not be nil")
+		}
+
+		o.logger = logger
+		return nil
+	}
+}
@@ -15,173 +15,132 @@
    along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
 
+
    The pubsub package provides a library for a simple pub-sub mechanism to subscribe to
-   topics as well as publish messages to and pull messages from topics.
+   topics as well as publish messages to and pull messages from topics. A single goroutine
+   (event loop) owns all the topics.
+
+   A PubSub[T] carries messages whose payload is of type T, so services embedding the
+   library get compile-time type safety:
+
+   pb, err := pubsub.New[Order]()
+   pb.Publish("orders", &pubsub.Message[Order]{Message: order})
+
+   PubMessage (a string payload) is the specialization used by the HTTP server. The types
+   and errors are aliases of the ones of the broker package and PubSub implements
+   broker.Broker, the event loop itself is shared with the other implementation (see
+   internal/engine).
 
 */
 
 package pubsub
 
 import (
-	"errors"
 	"time"
-)
 
-// publsiher message struct
-type PubMessage struct {
-	Message   string
-	Published time.Time
-}
+	"github.com/nakdesai/pub-sub/broker"
+	"github.com/nakdesai/pub-sub/internal/engine"
+)
 
-// request event struct
-type request struct {
-	action req
-	key    string
-	value  interface{}
-	result chan response
-}
+// message carrying a payload of type T
+type Message[T any] = broker.Message[T]
 
-// response event struct
-type response struct {
-	value interface{}
-	err   error
-}
+// publisher message struct, the message type of the HTTP server
+type PubMessage = broker.PubMessage
 
-type PubSub struct {
-	topicMap               map[string]map[string]chan interface{}
-	maxOutStandingMessages int
-	reqCh                  chan *request
-}
+// per-topic settings
+type TopicConfig = broker.TopicConfig
 
-var (
-	pb               *PubSub
-	ErrSubNotFound   = errors.New("Subscriber Not Found")
-	ErrTopicNotFound = errors.New("Topic Not Found")
-	ErrNoNewMessages = errors.New("No New Messages for Subscriber")
-)
+// what happens when a message is published to a topic whose backlog is full
+type OverflowPolicy = broker.OverflowPolicy
 
-type req int
+// function processing a message pushed by Consume
+type Handler[T any] = broker.Handler[T]
 
-// event type
-const (
-	ADD_SUB req = iota
-	DEL_SUB
-	GET_MSG
-	POST_MSG
-	CLOSE_QUEUE
-)
+// settings of a consumer
+type ConsumeOptions = broker.ConsumeOptions
 
-// the length of the request queue
-const REQUEST_QUEUE_SIZE int = 200
+// a rule forwarding the messages of a topic to another topic
+type ForwardingRule[T any] = broker.ForwardingRule[T]
 
-// Instantiate a new PubSub
-func NewPubSub(maxOutStandingMsgs int) *PubSub {
-	pb = &PubSub{
-		maxOutStandingMessages: maxOutStandingMsgs,
-		reqCh: make(chan *request, REQUEST_QUEUE_SIZE),
-	}
+// hooks run on the messages going through a PubSub
+type Interceptor[T any] = broker.Interceptor[T]
 
-	go pb.run()
-	return pb
-}
+// the highest message priority
+const MAX_PRIORITY = broker.MAX_PRIORITY
 
-// event handler goroutine to pull events from the request queue (channel) and process them
-func (pb *PubSub) run() {
-	pb.topicMap = make(map[string]map[string]chan interface{})
+// DedupWindow of a topic that does not deduplicate its publishes
+const NO_DEDUP = broker.NO_DEDUP
 
-	defer func() {
-		for topic := range pb.topicMap {
-			for sub := range pb.topicMap[topic] {
-				close(pb.topicMap[topic][sub])
-				delete(pb.topicMap[topic], sub)
-			}
+const (
+	DropOldest = broker.DropOldest
+	DropNewest = broker.DropNewest
+	Reject     = broker.Reject
+)
 
-			delete(pb.topicMap, topic)
-		}
+var (
+	ErrSubNotFound           = broker.ErrSubNotFound
+	ErrTopicNotFound         = broker.ErrTopicNotFound
+	ErrNoNewMessages         = broker.ErrNoNewMessages
+	ErrTopicExists           = broker.ErrTopicExists
+	ErrInvalidTopicConfig    = broker.ErrInvalidTopicConfig
+	ErrSubscriberExists      = broker.ErrSubscriberExists
+	ErrQueueFull             = broker.ErrQueueFull
+	ErrClosed                = broker.ErrClosed
+	ErrInvalidConsumeOptions = broker.ErrInvalidConsumeOptions
+	ErrInvalidBatch          = broker.ErrInvalidBatch
+	ErrMessageNotFound       = broker.ErrMessageNotFound
+	ErrInvalidPriority       = broker.ErrInvalidPriority
+	ErrInvalidRule           = broker.ErrInvalidRule
+	ErrRuleNotFound          = broker.ErrRuleNotFound
+	ErrForwardingLoop        = broker.ErrForwardingLoop
+	ErrRejected              = broker.ErrRejected
+)
 
-		pb.topicMap = nil
-
-	}()
-
-	// event loop
-	for r := range pb.reqCh {
-		switch r.action {
-
-		case ADD_SUB:
-			ch := make(chan interface{}, pb.maxOutStandingMessages)
-
-			if _, found := pb.topicMap[r.key]; !found {
-				pb.topicMap[r.key] = make(map[string]chan interface{})
-			}
-
-			pb.topicMap[r.key][r.value.(string)] = ch
-
-		case DEL_SUB:
-			if subMap, found := pb.topicMap[r.key]; found {
-				delete(subMap, r.value.(string))
-			}
-
-		case POST_MSG:
-			for _, ch := range pb.topicMap[r.key] {
-				select {
-				case ch <- r.value:
-				default:
-				}
-			}
-
-		case GET_MSG:
-			if subMap, found := pb.topicMap[r.key]; found {
-				if subCh, found := subMap[r.value.(string)]; found {
-					select {
-					case v := <-subCh:
-						r.result <- response{v, nil}
-					default:
-						r.result <- response{nil, ErrNoNewMessages}
-					}
-				} else {
-					r.result <- response{nil, ErrSubNotFound}
-				}
-			} else {
-				r.result <- response{nil, ErrTopicNotFound}
-			}
-
-		case CLOSE_QUEUE:
-			close(pb.reqCh)
-		}
-	}
+type PubSub[T any] struct {
+	*engine.Engine[T]
 }
 
-// subscribe to topics
-func (pb *PubSub) Subscribe(topicName, subscriberName string) {
-	pb.reqCh <- &request{ADD_SUB, topicName, subscriberName, nil}
-}
+var _ broker.Broker[string] = (*PubSub[string])(nil)
 
-// Unsubscribe to topics
-func (pb *PubSub) UnSubscribe(topicName, subscriberName string) {
-	pb.reqCh <- &request{DEL_SUB, topicName, subscriberName, nil}
-}
-
-// publish a message to a topic
-func (pb *PubSub) Publish(topicName string, msg *PubMessage) {
-	pb.reqCh <- &request{POST_MSG, topicName, msg, nil}
-}
+// the default length of the request queue
+const REQUEST_QUEUE_SIZE int = 200
 
-// pull the next message for the topic
-func (pb *PubSub) Get(topicName, subscriberName string) (*PubMessage, error) {
-	resp := make(chan response)
+// the default backlog of a topic
+const MAX_OUTSTANDING_MESSAGES int = 50
 
-	pb.reqCh <- &request{GET_MSG, topicName, subscriberName, resp}
+// the default dedup window of a topic
+const DEDUP_WINDOW = time.Minute * 5
 
-	r := <-resp
+// Instantiate a new PubSub of PubMessages. Topics are created implicitly on first use with a
+// backlog of maxOutStandingMsgs messages. Every PubSub is independent of the others.
+// It panics if maxOutStandingMsgs is not positive, use New to get an error instead.
+func NewPubSub(maxOutStandingMsgs int) *PubSub[string] {
+	pb, err := New[string](WithDefaultBacklog(maxOutStandingMsgs))
 
-	if r.err != nil {
-		return nil, r.err
+	if err != nil {
+		panic(err)
 	}
 
-	return r.value.(*PubMessage), r.err
+	return pb
 }
 
-// close the pubsub
-func (pb *PubSub) Close() {
-	pb.reqCh <- &request{action: CLOSE_QUEUE}
+// Instantiate a new PubSub of messages with a payload of type T configured by the options,
+// it fails if an option is invalid
+func New[T any](opts ...Option) (*PubSub[T], error) {
+	o := defaultOptions()
+
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return nil, err
+		}
+	}
+
+	return &PubSub[T]{engine.New[T](engine.Config{
+		Shards:        1,
+		QueueSize:     o.queueSize,
+		DefaultConfig: o.defaultConfig,
+		Clock:         o.clock,
+		Logger:        o.logger,
+	})}, nil
 }
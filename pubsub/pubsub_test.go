@@ -23,134 +23,97 @@
 package pubsub
 
 import (
+	"context"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/nakdesai/pub-sub/broker"
+	"github.com/nakdesai/pub-sub/broker/brokertest"
 )
 
 // test Subscribe()
 func TestSubscribe(t *testing.T) {
-	NewPubSub(20)
-
-	pb.Subscribe("testTopic", "testSubscriber")
+	t.Parallel()
 
-	// It is necessary to block here on a channel so that it can yield the cpu and
-	// let the event handler goroutine take over and perform the action
-	<-time.After(time.Millisecond * 10)
+	pb := NewPubSub(20)
 
-	subMap, found := pb.topicMap["testTopic"]
+	if err := pb.Subscribe("testTopic", "testSubscriber"); err != nil {
+		t.Errorf("Error subscribing: %s", err)
+	}
 
-	if !found {
+	if topics, _ := pb.ListTopics(); len(topics) != 1 || topics[0] != "testTopic" {
 		t.Errorf("Error inserting topic in map")
 	}
 
-	_, found = subMap["testSubscriber"]
-
-	if !found {
+	if err := pb.Subscribe("testTopic", "testSubscriber"); err != ErrSubscriberExists {
 		t.Errorf("Error inserting subscriber to topic map")
 	}
 
-	pb.Close()
+	pb.Close(context.Background())
 }
 
 // test Unsubscribe()
 func TestUnsubscribe(t *testing.T) {
-	NewPubSub(20)
-	pb.Subscribe("testTopic", "testSubscriber")
-
-	<-time.After(time.Millisecond * 10)
-
-	subMap, found := pb.topicMap["testTopic"]
-
-	if !found {
-		t.Errorf("Error inserting topic in map")
-	}
+	t.Parallel()
 
-	_, found = subMap["testSubscriber"]
+	pb := NewPubSub(20)
+	pb.Subscribe("testTopic", "testSubscriber")
 
-	if !found {
-		t.Errorf("Error inserting subscriber to topic map")
+	if err := pb.UnSubscribe("testTopic", "testSubscriber"); err != nil {
+		t.Errorf("Error unsubscribing: %s", err)
 	}
 
-	pb.UnSubscribe("testTopic", "testSubscriber")
-
-	<-time.After(time.Millisecond * 10)
-
-	subMap, found = pb.topicMap["testTopic"]
-
-	if !found {
+	if topics, _ := pb.ListTopics(); len(topics) != 1 {
 		t.Errorf("Unsubscribe deleted topic !!")
 	}
 
-	_, found = subMap["testSubscriber"]
-
-	if found {
+	if _, err := pb.Get("testTopic", "testSubscriber"); err != ErrSubNotFound {
 		t.Errorf("Error unsubscribing from subscriber map")
 	}
 
-	pb.Close()
+	pb.Close(context.Background())
 }
 
 // test Publish()
 func TestPublish(t *testing.T) {
-	NewPubSub(20)
+	t.Parallel()
+
+	pb := NewPubSub(20)
 	pb.Subscribe("newTopic", "sub1")
 	pb.Subscribe("newTopic", "sub2")
 	pb.Subscribe("newTopic", "sub3")
 
-	<-time.After(time.Millisecond * 10)
-
-	pubMsg := &PubMessage{"msg", time.Now()}
-
-	pb.Publish("newTopic", pubMsg)
-
-	<-time.After(time.Millisecond * 10)
-
-	recvMsg := <-pb.topicMap["newTopic"]["sub1"]
-
-	if recvMsg.(*PubMessage).Message != "msg" {
-		t.Errorf("Message not published to sub1")
-	}
+	pb.Publish("newTopic", &PubMessage{Message: "msg", Published: time.Now()})
 
-	recvMsg = <-pb.topicMap["newTopic"]["sub2"]
-
-	if recvMsg.(*PubMessage).Message != "msg" {
-		t.Errorf("Message not published to sub2")
-	}
-
-	recvMsg = <-pb.topicMap["newTopic"]["sub3"]
-
-	if recvMsg.(*PubMessage).Message != "msg" {
-		t.Errorf("Message not published to sub3")
+	for _, sub := range []string{"sub1", "sub2", "sub3"} {
+		if recvMsg, _ := pb.Get("newTopic", sub); recvMsg == nil || recvMsg.Message != "msg" {
+			t.Errorf("Message not published to %s", sub)
+		}
 	}
 
 	// Ensure new subscriber only gets the new message
 	pb.Subscribe("newTopic", "sub4")
+	pb.Publish("newTopic", &PubMessage{Message: "newMsg", Published: time.Now()})
 
-	<-time.After(time.Millisecond * 10)
-
-	pubMsg = &PubMessage{"newMsg", time.Now()}
-
-	pb.Publish("newTopic", pubMsg)
-
-	<-time.After(time.Millisecond * 10)
-
-	recvMsg = <-pb.topicMap["newTopic"]["sub4"]
-
-	if recvMsg.(*PubMessage).Message != "newMsg" {
+	if recvMsg, _ := pb.Get("newTopic", "sub4"); recvMsg == nil || recvMsg.Message != "newMsg" {
 		t.Errorf("New Message not published to sub4")
 	}
 
-	pb.Close()
+	pb.Close(context.Background())
 }
 
 // test Get()
 func TestGetMsg(t *testing.T) {
-	NewPubSub(20)
+	t.Parallel()
+
+	pb := NewPubSub(20)
 	pb.Subscribe("newTopic", "sub10")
 
 	<-time.After(time.Millisecond * 10)
 
-	pubMsg := &PubMessage{"sample_msg", time.Now()}
+	pubMsg := &PubMessage{Message: "sample_msg", Published: time.Now()}
 
 	pb.Publish("newTopic", pubMsg)
 
@@ -188,5 +151,335 @@ func TestGetMsg(t *testing.T) {
 		t.Errorf("Invalid topic not flagged")
 	}
 
-	pb.Close()
+	pb.Close(context.Background())
+}
+
+// test the topic lifecycle API
+func TestTopicLifecycle(t *testing.T) {
+	t.Parallel()
+
+	pb := NewPubSub(20)
+
+	if err := pb.CreateTopic("orders", TopicConfig{MaxBacklog: 5, Overflow: DropNewest}); err != nil {
+		t.Errorf("Error creating topic: %s", err)
+	}
+
+	if err := pb.CreateTopic("orders", TopicConfig{}); err != ErrTopicExists {
+		t.Errorf("Duplicate topic not flagged")
+	}
+
+	if err := pb.CreateTopic("bad", TopicConfig{TTL: -1}); err != ErrInvalidTopicConfig {
+		t.Errorf("Invalid topic config not flagged")
+	}
+
+	// implicitly created topic gets the default config
+	pb.Subscribe("audit", "sub1")
+
+	topics, _ := pb.ListTopics()
+
+	if len(topics) != 2 || topics[0] != "audit" || topics[1] != "orders" {
+		t.Errorf("Incorrect topic list %v", topics)
+	}
+
+	config, err := pb.GetTopicConfig("orders")
+
+	if err != nil || config.MaxBacklog != 5 || config.Overflow != DropNewest {
+		t.Errorf("Incorrect topic config %+v, %v", config, err)
+	}
+
+	config, err = pb.GetTopicConfig("audit")
+
+	if err != nil || config.MaxBacklog != 20 {
+		t.Errorf("Incorrect default topic config %+v, %v", config, err)
+	}
+
+	if err := pb.DeleteTopic("orders"); err != nil {
+		t.Errorf("Error deleting topic: %s", err)
+	}
+
+	if _, err := pb.GetTopicConfig("orders"); err != ErrTopicNotFound {
+		t.Errorf("Deleted topic still present")
+	}
+
+	if err := pb.DeleteTopic("orders"); err != ErrTopicNotFound {
+		t.Errorf("Deleting a missing topic not flagged")
+	}
+
+	pb.Close(context.Background())
+}
+
+// test that idle topics expire
+func TestTopicTTL(t *testing.T) {
+	t.Parallel()
+
+	pb := NewPubSub(20)
+
+	pb.CreateTopic("shortLived", TopicConfig{TTL: time.Millisecond * 10})
+
+	<-time.After(time.Millisecond * 20)
+
+	if _, err := pb.Get("shortLived", "sub1"); err != ErrTopicNotFound {
+		t.Errorf("Idle topic did not expire")
+	}
+
+	pb.Close(context.Background())
+}
+
+// test the errors returned by Subscribe, UnSubscribe and Publish
+func TestErrors(t *testing.T) {
+	t.Parallel()
+
+	pb := NewPubSub(1)
+
+	if err := pb.Subscribe("errTopic", "sub1"); err != nil {
+		t.Errorf("Error subscribing: %s", err)
+	}
+
+	if err := pb.Subscribe("errTopic", "sub1"); err != ErrSubscriberExists {
+		t.Errorf("Duplicate subscriber not flagged")
+	}
+
+	if err := pb.UnSubscribe("errTopic", "sub2"); err != ErrSubNotFound {
+		t.Errorf("Unknown subscriber not flagged")
+	}
+
+	if err := pb.UnSubscribe("noTopic", "sub1"); err != ErrTopicNotFound {
+		t.Errorf("Unknown topic not flagged")
+	}
+
+	pb.CreateTopic("fullTopic", TopicConfig{Overflow: Reject})
+	pb.Subscribe("fullTopic", "sub1")
+
+	if err := pb.Publish("fullTopic", &PubMessage{Message: "msg1", Published: time.Now()}); err != nil {
+		t.Errorf("Error publishing: %s", err)
+	}
+
+	if err := pb.Publish("fullTopic", &PubMessage{Message: "msg2", Published: time.Now()}); err != ErrQueueFull {
+		t.Errorf("Full queue not flagged")
+	}
+
+	pb.Close(context.Background())
+
+	if err := pb.Publish("errTopic", &PubMessage{Message: "msg", Published: time.Now()}); err != ErrClosed {
+		t.Errorf("Publish on a closed pubsub not flagged")
+	}
+
+	if _, err := pb.Get("errTopic", "sub1"); err != ErrClosed {
+		t.Errorf("Get on a closed pubsub not flagged")
+	}
+
+	pb.Close(context.Background())
+}
+
+// test that Close drains the pending requests and is idempotent
+func TestClose(t *testing.T) {
+	t.Parallel()
+
+	pb := NewPubSub(20)
+	pb.Subscribe("closeTopic", "sub1")
+
+	// keep the event loop busy while Close is called
+	for i := 0; i < 10; i++ {
+		go pb.Publish("closeTopic", &PubMessage{Message: "msg", Published: time.Now()})
+	}
+
+	if err := pb.Close(context.Background()); err != nil {
+		t.Errorf("Error closing: %s", err)
+	}
+
+	if err := pb.Close(context.Background()); err != nil {
+		t.Errorf("Error closing twice: %s", err)
+	}
+
+	if err := pb.Subscribe("closeTopic", "sub2"); err != ErrClosed {
+		t.Errorf("Subscribe on a closed pubsub not flagged")
+	}
+
+	if _, err := pb.ListTopics(); err != ErrClosed {
+		t.Errorf("ListTopics on a closed pubsub not flagged")
+	}
+}
+
+// test that Close with a cancelled context fails the pending requests
+func TestCloseAbort(t *testing.T) {
+	t.Parallel()
+
+	pb := NewPubSub(20)
+
+	results := make(chan error, 100)
+
+	for i := 0; i < 100; i++ {
+		go func() {
+			results <- pb.Subscribe("abortTopic", fmt.Sprintf("sub%d", i))
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := pb.Close(ctx); err != nil && err != context.Canceled {
+		t.Errorf("Unexpected error closing: %s", err)
+	}
+
+	// every caller gets an answer, nothing is left blocked
+	for i := 0; i < 100; i++ {
+		if err := <-results; err != nil && err != ErrClosed {
+			t.Errorf("Unexpected error: %s", err)
+		}
+	}
+}
+
+// test that two PubSub instances do not share any state
+func TestIndependentInstances(t *testing.T) {
+	t.Parallel()
+
+	pb1 := NewPubSub(20)
+	pb2 := NewPubSub(20)
+
+	pb1.Subscribe("sharedName", "sub1")
+	pb2.Subscribe("sharedName", "sub1")
+
+	pb1.Publish("sharedName", &PubMessage{Message: "msg", Published: time.Now()})
+
+	if _, err := pb2.Get("sharedName", "sub1"); err != ErrNoNewMessages {
+		t.Errorf("Message leaked to another instance")
+	}
+
+	pb1.Close(context.Background())
+
+	if err := pb2.Publish("sharedName", &PubMessage{Message: "msg", Published: time.Now()}); err != nil {
+		t.Errorf("Closing an instance affected another one: %s", err)
+	}
+
+	if msg, err := pb2.Get("sharedName", "sub1"); err != nil || msg.Message != "msg" {
+		t.Errorf("Error getting message from the second instance")
+	}
+
+	pb2.Close(context.Background())
+}
+
+// a clock moved by hand
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// test the options of New
+func TestOptions(t *testing.T) {
+	t.Parallel()
+
+	if _, err := New[string](WithQueueSize(-1)); err == nil {
+		t.Errorf("Invalid queue size not flagged")
+	}
+
+	if _, err := New[string](WithDefaultBacklog(-1)); err == nil {
+		t.Errorf("Invalid backlog not flagged")
+	}
+
+	if _, err := New[string](WithDefaultBacklog(0)); err == nil {
+		t.Errorf("Empty backlog not flagged")
+	}
+
+	if _, err := New[string](WithDefaultDedupWindow(-time.Second)); err == nil {
+		t.Errorf("Invalid dedup window not flagged")
+	}
+
+	if _, err := New[string](WithClock(nil)); err == nil {
+		t.Errorf("Invalid clock not flagged")
+	}
+
+	clock := &fakeClock{now: time.Now()}
+	pb, err := New[string](WithQueueSize(0), WithDefaultBacklog(5), WithClock(clock))
+
+	if err != nil {
+		t.Fatalf("Error creating pubsub: %s", err)
+	}
+
+	pb.CreateTopic("clockTopic", TopicConfig{Retention: time.Minute})
+	pb.Subscribe("clockTopic", "sub1")
+	pb.Publish("clockTopic", &PubMessage{Message: "msg", Published: time.Now()})
+
+	config, _ := pb.GetTopicConfig("clockTopic")
+
+	if config.MaxBacklog != 5 {
+		t.Errorf("Default backlog not applied")
+	}
+
+	// the message expires according to the injected clock
+	clock.Advance(time.Hour)
+
+	if _, err := pb.Get("clockTopic", "sub1"); err != ErrNoNewMessages {
+		t.Errorf("Message past its retention delivered")
+	}
+
+	pb.Close(context.Background())
+
+	// without auto creation the topics must be created first
+	pb, _ = New[string](WithAutoCreate(false))
+
+	if err := pb.Subscribe("topic", "sub1"); err != ErrTopicNotFound {
+		t.Errorf("Subscribe created a topic without auto creation: %v", err)
+	}
+
+	if err := pb.Publish("topic", &PubMessage{Message: "msg", Published: time.Now()}); err != ErrTopicNotFound {
+		t.Errorf("Publish created a topic without auto creation: %v", err)
+	}
+
+	if err := pb.PublishAtomic(map[string][]*PubMessage{"topic": {{Message: "msg"}}}); err != ErrTopicNotFound {
+		t.Errorf("PublishAtomic created a topic without auto creation: %v", err)
+	}
+
+	pb.CreateTopic("topic", TopicConfig{})
+
+	if err := pb.Subscribe("topic", "sub1"); err != nil {
+		t.Errorf("Error subscribing to a created topic: %v", err)
+	}
+
+	pb.Close(context.Background())
+}
+
+// test a PubSub carrying a struct payload
+func TestTypedPayload(t *testing.T) {
+	t.Parallel()
+
+	type order struct {
+		ID     int
+		Amount float64
+	}
+
+	pb, err := New[order]()
+
+	if err != nil {
+		t.Fatalf("Error creating pubsub: %s", err)
+	}
+
+	pb.Subscribe("orders", "billing")
+	pb.Publish("orders", &Message[order]{Message: order{ID: 7, Amount: 9.5}, Published: time.Now()})
+
+	msg, err := pb.Get("orders", "billing")
+
+	if err != nil || msg.Message.ID != 7 || msg.Message.Amount != 9.5 {
+		t.Errorf("Typed message not delivered: %v", err)
+	}
+
+	pb.Close(context.Background())
+}
+
+// run the broker conformance tests
+func TestConformance(t *testing.T) {
+	brokertest.Run(t, func(t *testing.T) broker.Broker[string] {
+		return NewPubSub(20)
+	})
 }
@@ -0,0 +1,183 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   This file contains the options accepted by New.
+
+   pb, err := pubsubScalable.New[string](
+       pubsubScalable.WithWorkers(4),
+       pubsubScalable.WithDefaultBacklog(100),
+   )
+
+*/
+
+package pubsubScalable
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"runtime"
+	"time"
+
+	"github.com/nakdesai/pub-sub/internal/engine"
+)
+
+// source of the current time, it can be replaced in tests
+type Clock = engine.Clock
+
+// the wall clock
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// settings of a PubSub, filled in by the options
+type options struct {
+	workers       int
+	queueSize     int
+	defaultConfig TopicConfig
+	hash          func(topic string) uint32
+	clock         Clock
+	logger        *slog.Logger
+}
+
+// an option configures a PubSub created by New
+type Option func(*options) error
+
+// default settings: one topic handler per CPU but one (at least one),
+// topic names hashed with FNV-1a
+func defaultOptions() options {
+	workers := runtime.NumCPU() - 1
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	return options{
+		workers:   workers,
+		queueSize: REQUEST_QUEUE_SIZE,
+		defaultConfig: TopicConfig{
+			MaxBacklog:  MAX_OUTSTANDING_MESSAGES,
+			DedupWindow: DEDUP_WINDOW,
+			AutoCreate:  true,
+		},
+		hash:  fnvHash,
+		clock: systemClock{},
+	}
+}
+
+func fnvHash(topic string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(topic))
+	return h.Sum32()
+}
+
+// number of topic handler goroutines the topic key space is split across
+func WithWorkers(n int) Option {
+	return func(o *options) error {
+		if n < 1 {
+			return fmt.Errorf("pubsubScalable: worker count must be at least 1, got %d", n)
+		}
+
+		o.workers = n
+		return nil
+	}
+}
+
+// length of the event queue of each topic handler
+func WithQueueSize(n int) Option {
+	return func(o *options) error {
+		if n < 0 {
+			return fmt.Errorf("pubsubScalable: queue size must not be negative, got %d", n)
+		}
+
+		o.queueSize = n
+		return nil
+	}
+}
+
+// backlog of the topics created without an explicit MaxBacklog
+func WithDefaultBacklog(n int) Option {
+	return func(o *options) error {
+		if n <= 0 {
+			return fmt.Errorf("pubsubScalable: default backlog must be positive, got %d", n)
+		}
+
+		o.defaultConfig.MaxBacklog = n
+		return nil
+	}
+}
+
+// dedup window of the topics created without an explicit DedupWindow
+func WithDefaultDedupWindow(d time.Duration) Option {
+	return func(o *options) error {
+		if d < 0 {
+			return fmt.Errorf("pubsubScalable: default dedup window must not be negative, got %v", d)
+		}
+
+		o.defaultConfig.DedupWindow = d
+		return nil
+	}
+}
+
+// function mapping a topic name to its topic handler (modulo the worker count)
+func WithHashFunc(hash func(topic string) uint32) Option {
+	return func(o *options) error {
+		if hash == nil {
+			return fmt.Errorf("pubsubScalable: hash function must not be nil")
+		}
+
+		o.hash = hash
+		return nil
+	}
+}
+
+// create the topics that never existed on Subscribe and Publish (the default), when off
+// they fail with ErrTopicNotFound until the topic is created with CreateTopic. An expired
+// topic is created again according to its own AutoCreate.
+func WithAutoCreate(on bool) Option {
+	return func(o *options) error {
+		o.defaultConfig.AutoCreate = on
+		return nil
+	}
+}
+
+// clock used to timestamp and expire messages and topics
+func WithClock(clock Clock) Option {
+	return func(o *options) error {
+		if clock == nil {
+			return fmt.Errorf("pubsubScalable: clock must not be nil")
+		}
+
+		o.clock = clock
+		return nil
+	}
+}
+
+// logger of the lifecycle events (topics created, deleted or expired, event loops started
+// and stopped), the dropped messages and the handler failures. By default nothing is logged.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) error {
+		if logger == nil {
+			return fmt.Errorf("pubsubScalable: logger must not be nil")
+		}
+
+		o.logger = logger
+		return nil
+	}
+}
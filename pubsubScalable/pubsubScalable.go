@@ -15,204 +15,134 @@
    along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
 
+
    The pubsubScalable package provides a library for a simple pub-sub mechanism to subscribe to
    topics as well as publish messages to and pull messages from topics. The library spawns a fixed
    number of goroutines (topic managers) and and each goroutine is responsible to manager a part of
    the topic key space (topic name is hashed to determine the topic manager)
 
+   A PubSub[T] carries messages whose payload is of type T, so services embedding the
+   library get compile-time type safety:
+
+   pb, err := pubsubScalable.New[Order]()
+   pb.Publish("orders", &pubsubScalable.Message[Order]{Message: order})
+
+   PubMessage (a string payload) is the specialization used by the HTTP server. The types
+   and errors are aliases of the ones of the broker package and PubSub implements
+   broker.Broker, the event loop itself is shared with the other implementation (see
+   internal/engine).
+
 */
 
 package pubsubScalable
 
 import (
-	"errors"
-	"hash/fnv"
-	"runtime"
 	"time"
-)
-
-// publisher message struct
-type PubMessage struct {
-	Message   string
-	Published time.Time
-}
-
-// request event struct
-type request struct {
-	action req
-	key    string
-	value  interface{}
-	result chan response
-}
-
-// response event struct
-type response struct {
-	value interface{}
-	err   error
-}
 
-// topic manager
-type topicHandler struct {
-	topicMap               map[string]map[string]chan interface{}
-	maxOutStandingMessages int
-	eventQueue             chan *request
-}
-
-type PubSub struct {
-	topicHandlerChannelLst []chan *request
-}
-
-type req int
-
-var (
-	pb               *PubSub
-	maxWorkers       uint32
-	ErrSubNotFound   = errors.New("Subscriber Not Found")
-	ErrTopicNotFound = errors.New("Topic Not Found")
-	ErrNoNewMessages = errors.New("No New Messages for Subscriber")
+	"github.com/nakdesai/pub-sub/broker"
+	"github.com/nakdesai/pub-sub/internal/engine"
 )
 
-const (
-	ADD_SUB req = iota
-	DEL_SUB
-	GET_MSG
-	POST_MSG
-	CLOSE_QUEUE
-)
+// message carrying a payload of type T
+type Message[T any] = broker.Message[T]
 
-// the length of the request queue
-const REQUEST_QUEUE_SIZE int = 100
+// publisher message struct, the message type of the HTTP server
+type PubMessage = broker.PubMessage
 
-// Instantiate a new PubSub
-func NewPubSub(maxOutStandingMsgs int) *PubSub {
-	maxWorkers = uint32(runtime.NumCPU() - 1)
+// per-topic settings
+type TopicConfig = broker.TopicConfig
 
-	pb = &PubSub{
-		topicHandlerChannelLst: make([]chan *request, maxWorkers),
-	}
+// what happens when a message is published to a topic whose backlog is full
+type OverflowPolicy = broker.OverflowPolicy
 
-	for i := 0; i < int(maxWorkers); i++ {
-		w := newTopicHandler(maxOutStandingMsgs)
-		pb.topicHandlerChannelLst[i] = w.eventQueue
-	}
+// function processing a message pushed by Consume
+type Handler[T any] = broker.Handler[T]
 
-	return pb
-}
+// settings of a consumer
+type ConsumeOptions = broker.ConsumeOptions
 
-// Instantiate a new topic handler
-func newTopicHandler(maxOutStandingMessages int) *topicHandler {
-	th := &topicHandler{
-		maxOutStandingMessages: maxOutStandingMessages,
-		eventQueue:             make(chan *request, REQUEST_QUEUE_SIZE),
-	}
+// a rule forwarding the messages of a topic to another topic
+type ForwardingRule[T any] = broker.ForwardingRule[T]
 
-	go th.run()
-	return th
-}
+// hooks run on the messages going through a PubSub
+type Interceptor[T any] = broker.Interceptor[T]
 
-// event handler goroutine to pull events from the event queue (channel) and process them
-func (th *topicHandler) run() {
-	th.topicMap = make(map[string]map[string]chan interface{})
+// the highest message priority
+const MAX_PRIORITY = broker.MAX_PRIORITY
 
-	// on cleanup close the susbcriber goroutines
-	defer func() {
-		for topic := range th.topicMap {
-			for sub := range th.topicMap[topic] {
-				close(th.topicMap[topic][sub])
-				delete(th.topicMap[topic], sub)
-			}
+// DedupWindow of a topic that does not deduplicate its publishes
+const NO_DEDUP = broker.NO_DEDUP
 
-			delete(th.topicMap, topic)
-		}
-	}()
-
-	// event loop
-	for r := range th.eventQueue {
-		switch r.action {
-
-		case ADD_SUB:
-			ch := make(chan interface{}, th.maxOutStandingMessages)
-
-			if _, found := th.topicMap[r.key]; !found {
-				th.topicMap[r.key] = make(map[string]chan interface{})
-			}
-
-			th.topicMap[r.key][r.value.(string)] = ch
-
-		case DEL_SUB:
-			if subMap, found := th.topicMap[r.key]; found {
-				delete(subMap, r.value.(string))
-			}
-
-		case POST_MSG:
-			for _, ch := range th.topicMap[r.key] {
-				select {
-				case ch <- r.value:
-				default:
-				}
-			}
-
-		case GET_MSG:
-			if subMap, found := th.topicMap[r.key]; found {
-				if subCh, found := subMap[r.value.(string)]; found {
-					select {
-					case v := <-subCh:
-						r.result <- response{v, nil}
-					default:
-						r.result <- response{nil, ErrNoNewMessages}
-					}
-				} else {
-					r.result <- response{nil, ErrSubNotFound}
-				}
-			} else {
-				r.result <- response{nil, ErrTopicNotFound}
-			}
-
-		case CLOSE_QUEUE:
-			close(th.eventQueue)
-		}
-	}
-}
+const (
+	DropOldest = broker.DropOldest
+	DropNewest = broker.DropNewest
+	Reject     = broker.Reject
+)
 
-func getHashIdx(topic string) uint32 {
-	h := fnv.New32a()
-	h.Write([]byte(topic))
-	return h.Sum32() % maxWorkers
-}
+var (
+	ErrSubNotFound           = broker.ErrSubNotFound
+	ErrTopicNotFound         = broker.ErrTopicNotFound
+	ErrNoNewMessages         = broker.ErrNoNewMessages
+	ErrTopicExists           = broker.ErrTopicExists
+	ErrInvalidTopicConfig    = broker.ErrInvalidTopicConfig
+	ErrSubscriberExists      = broker.ErrSubscriberExists
+	ErrQueueFull             = broker.ErrQueueFull
+	ErrClosed                = broker.ErrClosed
+	ErrInvalidConsumeOptions = broker.ErrInvalidConsumeOptions
+	ErrInvalidBatch          = broker.ErrInvalidBatch
+	ErrMessageNotFound       = broker.ErrMessageNotFound
+	ErrInvalidPriority       = broker.ErrInvalidPriority
+	ErrInvalidRule           = broker.ErrInvalidRule
+	ErrRuleNotFound          = broker.ErrRuleNotFound
+	ErrForwardingLoop        = broker.ErrForwardingLoop
+	ErrRejected              = broker.ErrRejected
+)
 
-// subscribe to topics
-func (pb *PubSub) Subscribe(topicName, subscriberName string) {
-	pb.topicHandlerChannelLst[getHashIdx(topicName)] <- &request{ADD_SUB, topicName, subscriberName, nil}
+type PubSub[T any] struct {
+	*engine.Engine[T]
 }
 
-// Unsubscribe to topics
-func (pb *PubSub) UnSubscribe(topicName, subscriberName string) {
-	pb.topicHandlerChannelLst[getHashIdx(topicName)] <- &request{DEL_SUB, topicName, subscriberName, nil}
-}
+var _ broker.Broker[string] = (*PubSub[string])(nil)
 
-// publish a message to a topic
-func (pb *PubSub) Publish(topicName string, msg *PubMessage) {
-	pb.topicHandlerChannelLst[getHashIdx(topicName)] <- &request{POST_MSG, topicName, msg, nil}
-}
+// the default length of the request queue
+const REQUEST_QUEUE_SIZE int = 100
 
-// pull the next message for the topic
-func (pb *PubSub) Get(topicName, subscriberName string) (*PubMessage, error) {
-	resp := make(chan response)
+// the default backlog of a topic
+const MAX_OUTSTANDING_MESSAGES int = 50
 
-	pb.topicHandlerChannelLst[getHashIdx(topicName)] <- &request{GET_MSG, topicName, subscriberName, resp}
+// the default dedup window of a topic
+const DEDUP_WINDOW = time.Minute * 5
 
-	r := <-resp
+// Instantiate a new PubSub of PubMessages. Topics are created implicitly on first use with a
+// backlog of maxOutStandingMsgs messages. Every PubSub is independent of the others.
+// It panics if maxOutStandingMsgs is not positive, use New to get an error instead.
+func NewPubSub(maxOutStandingMsgs int) *PubSub[string] {
+	pb, err := New[string](WithDefaultBacklog(maxOutStandingMsgs))
 
-	if r.err != nil {
-		return nil, r.err
+	if err != nil {
+		panic(err)
 	}
 
-	return r.value.(*PubMessage), r.err
+	return pb
 }
 
-// close the pubsub
-func (pb *PubSub) Close() {
-	for _, ch := range pb.topicHandlerChannelLst {
-		ch <- &request{action: CLOSE_QUEUE}
+// Instantiate a new PubSub of messages with a payload of type T configured by the options,
+// it fails if an option is invalid
+func New[T any](opts ...Option) (*PubSub[T], error) {
+	o := defaultOptions()
+
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return nil, err
+		}
 	}
+
+	return &PubSub[T]{engine.New[T](engine.Config{
+		Shards:        o.workers,
+		QueueSize:     o.queueSize,
+		DefaultConfig: o.defaultConfig,
+		Hash:          o.hash,
+		Clock:         o.clock,
+		Logger:        o.logger,
+	})}, nil
 }
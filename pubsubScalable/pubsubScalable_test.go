@@ -0,0 +1,137 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+   This file contains unit tests for the pubsubScalable package.
+
+   cmd to execute: "go test"
+
+*/
+
+package pubsubScalable
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nakdesai/pub-sub/broker"
+	"github.com/nakdesai/pub-sub/broker/brokertest"
+)
+
+// test the options of New
+func TestOptions(t *testing.T) {
+	t.Parallel()
+
+	if _, err := New[string](WithWorkers(0)); err == nil {
+		t.Errorf("Invalid worker count not flagged")
+	}
+
+	if _, err := New[string](WithHashFunc(nil)); err == nil {
+		t.Errorf("Invalid hash function not flagged")
+	}
+
+	if _, err := New[string](WithDefaultBacklog(-1)); err == nil {
+		t.Errorf("Invalid backlog not flagged")
+	}
+
+	if _, err := New[string](WithDefaultBacklog(0)); err == nil {
+		t.Errorf("Empty backlog not flagged")
+	}
+
+	if _, err := New[string](WithDefaultDedupWindow(-time.Second)); err == nil {
+		t.Errorf("Invalid dedup window not flagged")
+	}
+
+	// a single topic handler, as on a single CPU machine
+	pb, err := New[string](WithWorkers(1), WithQueueSize(0))
+
+	if err != nil {
+		t.Fatalf("Error creating pubsub: %s", err)
+	}
+
+	pb.Subscribe("topic", "sub1")
+	pb.Publish("topic", &PubMessage{Message: "msg", Published: time.Now()})
+
+	if msg, err := pb.Get("topic", "sub1"); err != nil || msg.Message != "msg" {
+		t.Errorf("Error getting message with a single worker: %v", err)
+	}
+
+	pb.Close(context.Background())
+
+	// without auto creation the topics must be created first
+	pb, _ = New[string](WithAutoCreate(false))
+
+	if err := pb.Subscribe("topic", "sub1"); err != ErrTopicNotFound {
+		t.Errorf("Subscribe created a topic without auto creation: %v", err)
+	}
+
+	if err := pb.Publish("topic", &PubMessage{Message: "msg", Published: time.Now()}); err != ErrTopicNotFound {
+		t.Errorf("Publish created a topic without auto creation: %v", err)
+	}
+
+	if err := pb.PublishAtomic(map[string][]*PubMessage{"topic": {{Message: "msg"}}}); err != ErrTopicNotFound {
+		t.Errorf("PublishAtomic created a topic without auto creation: %v", err)
+	}
+
+	pb.CreateTopic("topic", TopicConfig{})
+
+	if err := pb.Subscribe("topic", "sub1"); err != nil {
+		t.Errorf("Error subscribing to a created topic: %v", err)
+	}
+
+	pb.Close(context.Background())
+}
+
+// test that topics are routed to the topic handler picked by the hash function
+func TestHashFunc(t *testing.T) {
+	t.Parallel()
+
+	var hashed atomic.Int32
+
+	pb, _ := New[string](WithWorkers(4), WithHashFunc(func(topic string) uint32 {
+		hashed.Add(1)
+		return uint32(len(topic))
+	}))
+
+	// topics owned by different topic handlers are all listed
+	for _, topicName := range []string{"a", "ab", "abc", "abcd"} {
+		pb.CreateTopic(topicName, TopicConfig{})
+	}
+
+	if hashed.Load() != 4 {
+		t.Errorf("Hash function not used")
+	}
+
+	if topics, _ := pb.ListTopics(); len(topics) != 4 {
+		t.Errorf("Incorrect topic list %v", topics)
+	}
+
+	pb.Close(context.Background())
+}
+
+// run the broker conformance tests, the topics are spread across several topic handlers
+func TestConformance(t *testing.T) {
+	brokertest.Run(t, func(t *testing.T) broker.Broker[string] {
+		pb, err := New[string](WithWorkers(4), WithDefaultBacklog(20))
+
+		if err != nil {
+			t.Fatalf("Error creating pubsub: %s", err)
+		}
+
+		return pb
+	})
+}
@@ -0,0 +1,231 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   Reload of the settings of the PubSub server, on SIGHUP or POST /admin/reload. The config
+   file, the environment variables and the flags are loaded again and the settings that can
+   change on the fly are applied to the running server without losing the queued messages:
+   the auth tokens, the limits, the log level, the topics (created or reconfigured) and the
+   forwarding rules of the config. The other settings only apply on restart, they are
+   reported. An invalid config is refused as a whole.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nakdesai/pub-sub/broker"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// where the settings are loaded from, set by main
+var source configSource
+
+// one reload at a time
+var reloadMu sync.Mutex
+
+// outcome of a reload
+type reloadReport struct {
+	Applied         []string // the settings changed
+	RestartRequired []string // the settings changed that only apply on restart
+	Errors          []string // the settings that could not be applied, they keep their value
+}
+
+// create the topics of the config and reconfigure the existing ones whose settings changed
+// since old. A topic removed from the config is not deleted.
+func applyTopics(old, c *serverConfig) (applied []string, errs []error) {
+	for topicName, tc := range c.Topics {
+		if prev, found := old.Topics[topicName]; found && prev == tc {
+			continue
+		}
+
+		config, _ := tc.parse()
+		err := pb.SetTopicConfig(topicName, config)
+
+		if err == broker.ErrTopicNotFound {
+			err = pb.CreateTopic(topicName, config)
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Topics.%s: %v", topicName, err))
+
+			if prev, found := old.Topics[topicName]; found {
+				c.Topics[topicName] = prev
+			} else {
+				delete(c.Topics, topicName)
+			}
+
+			continue
+		}
+
+		applied = append(applied, "Topics."+topicName)
+	}
+
+	return applied, errs
+}
+
+// set the forwarding rules of the config that changed since old and delete the ones removed
+// from it (the rules set through the admin endpoints are not touched)
+func applyRules(old, c *serverConfig) (applied []string, errs []error) {
+	// the rules removed go first, they could make the new ones form a loop
+	for name, prev := range old.Rules {
+		if _, found := c.Rules[name]; found {
+			continue
+		}
+
+		if err := removeRule(name); err != nil && err != broker.ErrRuleNotFound {
+			errs = append(errs, fmt.Errorf("Rules.%s: %v", name, err))
+
+			if c.Rules == nil {
+				c.Rules = make(map[string]forwardingRule)
+			}
+
+			c.Rules[name] = prev
+			continue
+		}
+
+		applied = append(applied, "Rules."+name)
+	}
+
+	for name, fr := range c.Rules {
+		if prev, found := old.Rules[name]; found && reflect.DeepEqual(prev, fr) {
+			continue
+		}
+
+		if err := setRule(name, fr); err != nil {
+			errs = append(errs, fmt.Errorf("Rules.%s: %v", name, err))
+
+			if prev, found := old.Rules[name]; found {
+				c.Rules[name] = prev
+			} else {
+				delete(c.Rules, name)
+			}
+
+			continue
+		}
+
+		applied = append(applied, "Rules."+name)
+	}
+
+	return applied, errs
+}
+
+// load the settings again and apply them, see the top of the file
+func reload() (reloadReport, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	var report reloadReport
+
+	c, err := source.load()
+
+	if err != nil {
+		logger.Error("reload refused, invalid config", "err", err)
+		return report, err
+	}
+
+	old := currentConfig()
+
+	changed := func(name string, prev, next interface{}) bool {
+		if reflect.DeepEqual(prev, next) {
+			return false
+		}
+
+		report.Applied = append(report.Applied, name)
+		return true
+	}
+
+	// the settings read at startup keep their value until the restart
+	for name, values := range map[string][2]interface{}{
+		"IP":                 {old.IP, c.IP},
+		"Port":               {old.Port, c.Port},
+		"Backend":            {old.Backend, c.Backend},
+		"Workers":            {old.Workers, c.Workers},
+		"QueueSize":          {old.QueueSize, c.QueueSize},
+		"DefaultBacklog":     {old.DefaultBacklog, c.DefaultBacklog},
+		"DefaultDedupWindow": {old.DefaultDedupWindow, c.DefaultDedupWindow},
+		"AutoCreate":         {old.AutoCreate, c.AutoCreate},
+		"Log.Format":         {old.Log.Format, c.Log.Format},
+		"Trace":              {old.Trace, c.Trace},
+		"Redact":             {old.Redact, c.Redact},
+	} {
+		if !reflect.DeepEqual(values[0], values[1]) {
+			report.RestartRequired = append(report.RestartRequired, name)
+		}
+	}
+
+	c.IP, c.Port, c.Backend, c.Workers, c.QueueSize = old.IP, old.Port, old.Backend, old.Workers, old.QueueSize
+	c.DefaultBacklog, c.DefaultDedupWindow, c.AutoCreate = old.DefaultBacklog, old.DefaultDedupWindow, old.AutoCreate
+	c.Log.Format, c.Trace, c.Redact = old.Log.Format, old.Trace, old.Redact
+
+	changed("Auth", old.Auth, c.Auth)
+	changed("Limits.MaxBodyBytes", old.Limits.MaxBodyBytes, c.Limits.MaxBodyBytes)
+	changed("Limits.RequestTimeout", old.Limits.RequestTimeout, c.Limits.RequestTimeout)
+	changed("Limits.ShutdownTimeout", old.Limits.ShutdownTimeout, c.Limits.ShutdownTimeout)
+
+	if changed("Log.Level", old.Log.Level, c.Log.Level) {
+		level, _ := parseLevel(c.Log.Level)
+		logLevel.Set(level)
+	}
+
+	topics, topicErrs := applyTopics(old, &c)
+	rules, ruleErrs := applyRules(old, &c)
+
+	report.Applied = append(report.Applied, append(topics, rules...)...)
+
+	for _, err := range append(topicErrs, ruleErrs...) {
+		report.Errors = append(report.Errors, err.Error())
+	}
+
+	settings.Store(&c)
+
+	sort.Strings(report.Applied)
+	sort.Strings(report.RestartRequired)
+	sort.Strings(report.Errors)
+
+	logger.Info("config reloaded", "applied", report.Applied, "restart_required", report.RestartRequired)
+
+	for _, err := range report.Errors {
+		logger.Warn("setting not applied", "err", err)
+	}
+
+	return report, nil
+}
+
+// reload the settings, the response is the report of the reload
+func reloadConfig(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	report, err := reload()
+	w.Header().Set("Content-Type", "application/json")
+
+	switch {
+	case err != nil:
+		w.WriteHeader(http.StatusBadRequest)
+		report.Errors = strings.Split(err.Error(), "\n")
+	case len(report.Errors) > 0:
+		w.WriteHeader(http.StatusConflict)
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,152 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   This file contains the compatibility check between schema versions. The consumers of a
+   topic were written for the schemas already registered, so a new version must only accept
+   documents the previous one accepts: it may add constraints, not relax them. The check is
+   conservative, it may refuse a schema that only accepts valid documents in a roundabout way.
+
+*/
+
+package schema
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// the reasons documents valid for next may not be valid for prev, nil if next is compatible
+func Incompatibilities(prev, next *Schema) []string {
+	var problems []string
+	incompatibilities("", prev, next, &problems)
+	return problems
+}
+
+func incompatibilities(path string, prev, next *Schema, problems *[]string) {
+	fail := func(format string, args ...interface{}) {
+		*problems = append(*problems, pathOrRoot(path)+": "+fmt.Sprintf(format, args...))
+	}
+
+	if len(prev.Type) > 0 {
+		if len(next.Type) == 0 {
+			fail("type %v is no longer enforced", prev.Type)
+		}
+
+		for _, t := range next.Type {
+			if !prev.Type.allows(t) {
+				fail("type %s is not allowed by the previous version", t)
+			}
+		}
+	}
+
+	for _, name := range prev.Required {
+		if !contains(next.Required, name) {
+			fail("property %q is no longer required", name)
+		}
+	}
+
+	closed := next.AdditionalProperties != nil && !*next.AdditionalProperties
+
+	if prev.AdditionalProperties != nil && !*prev.AdditionalProperties {
+		if !closed {
+			fail("additional properties are allowed")
+		}
+
+		for _, name := range sortedNames(next.Properties) {
+			if _, found := prev.Properties[name]; !found {
+				fail("property %q is not allowed by the previous version", name)
+			}
+		}
+	}
+
+	for _, name := range sortedNames(prev.Properties) {
+		if p, found := next.Properties[name]; found {
+			incompatibilities(path+"/properties/"+name, prev.Properties[name], p, problems)
+		} else if !closed {
+			fail("property %q is no longer constrained", name)
+		}
+	}
+
+	if prev.Items != nil {
+		if next.Items == nil {
+			fail("items are no longer constrained")
+		} else {
+			incompatibilities(path+"/items", prev.Items, next.Items, problems)
+		}
+	}
+
+	if len(prev.Enum) > 0 {
+		if len(next.Enum) == 0 {
+			fail("enum is no longer enforced")
+		}
+
+		for _, e := range next.Enum {
+			if !containsValue(prev.Enum, e) {
+				fail("enum value %v is not allowed by the previous version", e)
+			}
+		}
+	}
+
+	if prev.Minimum != nil && (next.Minimum == nil || *next.Minimum < *prev.Minimum) {
+		fail("minimum lowered")
+	}
+
+	if prev.Maximum != nil && (next.Maximum == nil || *next.Maximum > *prev.Maximum) {
+		fail("maximum raised")
+	}
+
+	if prev.MinLength != nil && (next.MinLength == nil || *next.MinLength < *prev.MinLength) {
+		fail("minLength lowered")
+	}
+
+	if prev.MaxLength != nil && (next.MaxLength == nil || *next.MaxLength > *prev.MaxLength) {
+		fail("maxLength raised")
+	}
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsValue(values []interface{}, v interface{}) bool {
+	for _, e := range values {
+		if reflect.DeepEqual(e, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sortedNames(properties map[string]*Schema) []string {
+	names := make([]string, 0, len(properties))
+
+	for name := range properties {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
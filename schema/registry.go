@@ -0,0 +1,119 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   This file contains the schema registry. Each topic has a list of schema versions, the
+   messages published to the topic are validated against the latest one and a new version
+   is only registered if it is compatible with the latest one.
+
+*/
+
+package schema
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrSchemaNotFound = errors.New("Schema Not Found")
+)
+
+// a new version is refused as it would break the consumers of the topic
+type IncompatibleError struct {
+	Problems []string
+}
+
+func (e *IncompatibleError) Error() string {
+	return "incompatible schema: " + strings.Join(e.Problems, ", ")
+}
+
+// a registered schema
+type Version struct {
+	Version int
+	Schema  *Schema
+}
+
+// versioned schemas by topic, safe for concurrent use
+type Registry struct {
+	mu     sync.RWMutex
+	topics map[string][]*Version
+}
+
+func NewRegistry() *Registry {
+	return &Registry{topics: make(map[string][]*Version)}
+}
+
+// register a new schema version for a topic, it returns the version number
+// or an *IncompatibleError if the schema is not compatible with the latest version
+func (r *Registry) Register(topicName string, s *Schema) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	versions := r.topics[topicName]
+
+	if len(versions) > 0 {
+		if problems := Incompatibilities(versions[len(versions)-1].Schema, s); problems != nil {
+			return 0, &IncompatibleError{Problems: problems}
+		}
+	}
+
+	v := &Version{Version: len(versions) + 1, Schema: s}
+	r.topics[topicName] = append(versions, v)
+
+	return v.Version, nil
+}
+
+// the latest schema version of a topic
+func (r *Registry) Latest(topicName string) (*Version, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	versions := r.topics[topicName]
+
+	if len(versions) == 0 {
+		return nil, ErrSchemaNotFound
+	}
+
+	return versions[len(versions)-1], nil
+}
+
+// a schema version of a topic, numbered from 1
+func (r *Registry) Version(topicName string, version int) (*Version, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	versions := r.topics[topicName]
+
+	if version < 1 || version > len(versions) {
+		return nil, ErrSchemaNotFound
+	}
+
+	return versions[version-1], nil
+}
+
+// validate a json document published to a topic against its latest schema,
+// a topic without a schema accepts any document
+func (r *Registry) Validate(topicName string, data []byte) []ValidationError {
+	v, err := r.Latest(topicName)
+
+	if err != nil {
+		return nil
+	}
+
+	return v.Schema.ValidateJSON(data)
+}
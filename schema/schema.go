@@ -0,0 +1,275 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   The schema package validates json documents against a subset of JSON Schema and keeps a
+   registry of versioned schemas by topic. The supported keywords are type, properties,
+   required, additionalProperties (a boolean), items, enum, minimum, maximum, minLength and
+   maxLength; the other keywords are ignored.
+
+   s, err := schema.Parse([]byte(`{"type": "object", "required": ["id"]}`))
+   errs := s.Validate(doc)
+
+*/
+
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// a json schema
+type Schema struct {
+	Type                 Types              `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+}
+
+// the types a value may have, a single type or an array of types in json
+type Types []string
+
+// the json types
+var validTypes = map[string]bool{
+	"object": true, "array": true, "string": true, "number": true, "integer": true, "boolean": true, "null": true,
+}
+
+func (t *Types) UnmarshalJSON(data []byte) error {
+	var one string
+
+	if err := json.Unmarshal(data, &one); err == nil {
+		*t = Types{one}
+		return nil
+	}
+
+	var many []string
+
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("type must be a string or an array of strings")
+	}
+
+	*t = many
+	return nil
+}
+
+// a reason a document does not conform to a schema
+type ValidationError struct {
+	Path    string // json pointer to the value, "" for the document
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+
+	return e.Path + ": " + e.Message
+}
+
+// parse a schema, it fails on invalid json or an unknown type
+func Parse(data []byte) (*Schema, error) {
+	var s Schema
+
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+
+	if err := s.check(""); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// check the types of the schema and of its subschemas
+func (s *Schema) check(path string) error {
+	for _, t := range s.Type {
+		if !validTypes[t] {
+			return fmt.Errorf("%s: unknown type %q", pathOrRoot(path), t)
+		}
+	}
+
+	for name, p := range s.Properties {
+		if p == nil {
+			return fmt.Errorf("%s: property %q has no schema", pathOrRoot(path), name)
+		}
+
+		if err := p.check(path + "/properties/" + name); err != nil {
+			return err
+		}
+	}
+
+	if s.Items != nil {
+		return s.Items.check(path + "/items")
+	}
+
+	return nil
+}
+
+func pathOrRoot(path string) string {
+	if path == "" {
+		return "/"
+	}
+
+	return path
+}
+
+// validate a json document, it returns nil if it conforms to the schema
+func (s *Schema) ValidateJSON(data []byte) []ValidationError {
+	var doc interface{}
+
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return []ValidationError{{Message: "invalid json: " + err.Error()}}
+	}
+
+	return s.Validate(doc)
+}
+
+// validate a decoded json value (as decoded into an interface{} by encoding/json)
+func (s *Schema) Validate(doc interface{}) []ValidationError {
+	var errs []ValidationError
+	s.validate("", doc, &errs)
+	return errs
+}
+
+// the json type of a decoded value
+func typeOf(v interface{}) string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+
+		return "number"
+	case bool:
+		return "boolean"
+	}
+
+	return "null"
+}
+
+// check if a value of type vt is one of the types
+func (t Types) allows(vt string) bool {
+	if len(t) == 0 {
+		return true
+	}
+
+	for _, typ := range t {
+		if typ == vt || (typ == "number" && vt == "integer") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Schema) validate(path string, v interface{}, errs *[]ValidationError) {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	vt := typeOf(v)
+
+	if !s.Type.allows(vt) {
+		fail("expected %s, got %s", strings.Join(s.Type, " or "), vt)
+		return
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+
+		for _, e := range s.Enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			fail("value not in the enum")
+		}
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, found := v[name]; !found {
+				fail("missing required property %q", name)
+			}
+		}
+
+		names := make([]string, 0, len(v))
+
+		for name := range v {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			if p, found := s.Properties[name]; found {
+				p.validate(path+"/"+name, v[name], errs)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				fail("unexpected property %q", name)
+			}
+		}
+
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(fmt.Sprintf("%s/%d", path, i), item, errs)
+			}
+		}
+
+	case string:
+		n := utf8.RuneCountInString(v)
+
+		if s.MinLength != nil && n < *s.MinLength {
+			fail("shorter than %d characters", *s.MinLength)
+		}
+
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail("longer than %d characters", *s.MaxLength)
+		}
+
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			fail("less than the minimum %v", *s.Minimum)
+		}
+
+		if s.Maximum != nil && v > *s.Maximum {
+			fail("greater than the maximum %v", *s.Maximum)
+		}
+	}
+}
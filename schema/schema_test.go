@@ -0,0 +1,195 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   This file contains unit tests for the schema package.
+
+   cmd to execute: "go test"
+
+*/
+
+package schema
+
+import (
+	"testing"
+)
+
+func mustParse(t *testing.T, data string) *Schema {
+	t.Helper()
+
+	s, err := Parse([]byte(data))
+
+	if err != nil {
+		t.Fatalf("Error parsing %s: %v", data, err)
+	}
+
+	return s
+}
+
+const orderSchema = `{
+	"type": "object",
+	"required": ["id", "amount"],
+	"properties": {
+		"id": {"type": "integer", "minimum": 1},
+		"amount": {"type": "number", "maximum": 1000},
+		"currency": {"type": "string", "enum": ["EUR", "USD"]},
+		"tags": {"type": "array", "items": {"type": "string", "maxLength": 5}}
+	}
+}`
+
+// test the validation of documents and the reported errors
+func TestValidate(t *testing.T) {
+	s := mustParse(t, orderSchema)
+
+	for doc, want := range map[string][]ValidationError{
+		`{"id": 1, "amount": 9.5, "currency": "EUR", "tags": ["a"]}`: nil,
+		`{"id": 1}`:                                  {{Path: "", Message: `missing required property "amount"`}},
+		`{"id": 1.5, "amount": 1}`:                   {{Path: "/id", Message: "expected integer, got number"}},
+		`{"id": 0, "amount": 2000}`:                  {{Path: "/amount", Message: "greater than the maximum 1000"}, {Path: "/id", Message: "less than the minimum 1"}},
+		`{"id": 1, "amount": 1, "currency": "GBP"}`:  {{Path: "/currency", Message: "value not in the enum"}},
+		`{"id": 1, "amount": 1, "tags": ["long!!"]}`: {{Path: "/tags/0", Message: "longer than 5 characters"}},
+		`[1]`:  {{Path: "", Message: "expected object, got array"}},
+		`{"id`: {{Path: "", Message: "invalid json: unexpected end of JSON input"}},
+	} {
+		got := s.ValidateJSON([]byte(doc))
+
+		if len(got) != len(want) {
+			t.Errorf("%s: expected %v, got %v", doc, want, got)
+			continue
+		}
+
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("%s: expected %v, got %v", doc, want[i], got[i])
+			}
+		}
+	}
+
+	closed := mustParse(t, `{"properties": {"a": {}}, "additionalProperties": false}`)
+
+	if errs := closed.ValidateJSON([]byte(`{"a": 1, "b": 2}`)); len(errs) != 1 || errs[0].Path != "" {
+		t.Errorf("unexpected property not flagged: %v", errs)
+	}
+
+	nullable := mustParse(t, `{"type": ["string", "null"]}`)
+
+	if errs := nullable.ValidateJSON([]byte(`null`)); errs != nil {
+		t.Errorf("null refused: %v", errs)
+	}
+}
+
+// test that invalid schemas are refused
+func TestParse(t *testing.T) {
+	for _, data := range []string{
+		`{"type": "text"}`,
+		`{"type": 1}`,
+		`{"properties": {"a": {"type": "list"}}}`,
+		`{"items": {"type": ["string", "chars"]}}`,
+		`not json`,
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("invalid schema %s not flagged", data)
+		}
+	}
+}
+
+// test the compatibility checks between versions
+func TestIncompatibilities(t *testing.T) {
+	prev := mustParse(t, orderSchema)
+
+	for next, compatible := range map[string]bool{
+		// stricter versions
+		`{"type": "object", "required": ["id", "amount", "currency"], "properties": {
+			"id": {"type": "integer", "minimum": 1}, "amount": {"type": "integer", "maximum": 500},
+			"currency": {"type": "string", "enum": ["EUR"]}, "tags": {"type": "array", "items": {"type": "string", "maxLength": 3}}}}`: true,
+		orderSchema: true,
+		// relaxed versions
+		`{"type": "object", "required": ["id"], "properties": {
+			"id": {"type": "integer", "minimum": 1}, "amount": {"type": "number", "maximum": 1000},
+			"currency": {"type": "string", "enum": ["EUR", "USD"]}, "tags": {"type": "array", "items": {"type": "string", "maxLength": 5}}}}`: false,
+		`{"type": "object", "required": ["id", "amount"], "properties": {
+			"id": {"type": "string"}, "amount": {"type": "number", "maximum": 1000},
+			"currency": {"type": "string", "enum": ["EUR", "USD"]}, "tags": {"type": "array", "items": {"type": "string", "maxLength": 5}}}}`: false,
+		`{"type": "object", "required": ["id", "amount"], "properties": {
+			"id": {"type": "integer", "minimum": 1}, "amount": {"type": "number", "maximum": 1000},
+			"currency": {"type": "string", "enum": ["EUR", "USD", "GBP"]}, "tags": {"type": "array", "items": {"type": "string", "maxLength": 5}}}}`: false,
+		`{"type": "object", "required": ["id", "amount"]}`: false,
+		`{}`: false,
+	} {
+		problems := Incompatibilities(prev, mustParse(t, next))
+
+		if (problems == nil) != compatible {
+			t.Errorf("%s: expected compatible %v, got problems %v", next, compatible, problems)
+		}
+	}
+
+	closed := mustParse(t, `{"properties": {"a": {}}, "additionalProperties": false}`)
+
+	if Incompatibilities(closed, mustParse(t, `{"properties": {"a": {}, "b": {}}, "additionalProperties": false}`)) == nil {
+		t.Errorf("new property of a closed object not flagged")
+	}
+
+	if Incompatibilities(closed, mustParse(t, `{"properties": {"a": {}}}`)) == nil {
+		t.Errorf("opening a closed object not flagged")
+	}
+}
+
+// test the versions of the registry
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+
+	if errs := r.Validate("orders", []byte(`not json`)); errs != nil {
+		t.Errorf("topic without a schema refused a document: %v", errs)
+	}
+
+	if _, err := r.Latest("orders"); err != ErrSchemaNotFound {
+		t.Errorf("expected ErrSchemaNotFound, got %v", err)
+	}
+
+	if v, err := r.Register("orders", mustParse(t, orderSchema)); v != 1 || err != nil {
+		t.Errorf("Register: expected version 1, got %d, %v", v, err)
+	}
+
+	_, err := r.Register("orders", mustParse(t, `{}`))
+
+	if ie, ok := err.(*IncompatibleError); !ok || len(ie.Problems) == 0 {
+		t.Errorf("Register: expected an IncompatibleError, got %v", err)
+	}
+
+	stricter := mustParse(t, `{"type": "object", "required": ["id", "amount", "currency"], "properties": {
+		"id": {"type": "integer", "minimum": 1}, "amount": {"type": "number", "maximum": 1000},
+		"currency": {"type": "string", "enum": ["EUR", "USD"]}, "tags": {"type": "array", "items": {"type": "string", "maxLength": 5}}}}`)
+
+	if v, err := r.Register("orders", stricter); v != 2 || err != nil {
+		t.Errorf("Register: expected version 2, got %d, %v", v, err)
+	}
+
+	if v, _ := r.Latest("orders"); v == nil || v.Version != 2 {
+		t.Errorf("Latest: expected version 2, got %v", v)
+	}
+
+	if v, _ := r.Version("orders", 1); v == nil || v.Version != 1 {
+		t.Errorf("Version: expected version 1, got %v", v)
+	}
+
+	if _, err := r.Version("orders", 3); err != ErrSchemaNotFound {
+		t.Errorf("Version 3: expected ErrSchemaNotFound, got %v", err)
+	}
+
+	if errs := r.Validate("orders", []byte(`{"id": 1, "amount": 1}`)); len(errs) != 1 {
+		t.Errorf("Validate against the latest version: expected 1 error, got %v", errs)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   Schema registry of the PubSub server. A topic can have a JSON Schema (with versions) its
+   messages must conform to, the message strings are validated as json documents by the
+   broker before they are stored, whether they are published or forwarded. The schemas are
+   managed with the admin endpoints under /admin/schemas.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/nakdesai/pub-sub/broker"
+	"github.com/nakdesai/pub-sub/schema"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var schemas = schema.NewRegistry()
+
+// why a published message was refused
+type messageErrors struct {
+	Topic  string
+	Index  int // position of the message in its batch
+	Errors []schema.ValidationError
+}
+
+// a message that does not conform to the schema of its topic
+type schemaError []schema.ValidationError
+
+func (e schemaError) Error() string {
+	msgs := make([]string, len(e))
+
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+
+	return "schema: " + strings.Join(msgs, "; ")
+}
+
+// check the messages stored in a topic against the schema of the topic
+func validateSchemas() broker.Interceptor[string] {
+	return broker.Interceptor[string]{
+		Validate: func(topicName string, msg *broker.PubMessage) error {
+			if errs := schemas.Validate(topicName, []byte(msg.Message)); errs != nil {
+				return schemaError(errs)
+			}
+
+			return nil
+		},
+	}
+}
+
+// answer a failed publish, with 422 and the validation errors if a message does not
+// conform to the schema of its topic
+func publishFailed(w http.ResponseWriter, err error) {
+	var invalid *broker.MessageError
+	var errs schemaError
+
+	if !errors.As(err, &invalid) || !errors.As(invalid.Err, &errs) {
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode([]messageErrors{{Topic: invalid.Topic, Index: invalid.Index, Errors: errs}})
+}
+
+// register a new schema version for a topic
+func putSchema(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	data, err := io.ReadAll(r.Body)
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s, err := schema.Parse(data)
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	version, err := schemas.Register(params.ByName("topic_name"), s)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct{ Version int }{version})
+}
+
+// get the latest schema version of a topic, or the one of /:version
+func getSchema(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var v *schema.Version
+	var err error
+
+	if version := params.ByName("version"); version != "" {
+		n, convErr := strconv.Atoi(version)
+
+		if convErr != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		v, err = schemas.Version(params.ByName("topic_name"), n)
+	} else {
+		v, err = schemas.Latest(params.ByName("topic_name"))
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,97 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   Graceful shutdown of the PubSub server. On SIGINT or SIGTERM the server stops accepting
+   connections and waits for the requests in flight (including the ones blocked waiting for a
+   reply) until the Limits.ShutdownTimeout deadline (-shutdown-timeout). The broker is then closed: the requests still
+   blocked fail with 503 and the queued ones are drained, both within DRAIN_TIMEOUT. The
+   messages are kept in memory only, so there is no storage to flush.
+
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// how long the requests in flight have to finish on shutdown
+const SHUTDOWN_TIMEOUT = time.Second * 15
+
+// how long the broker has to drain once closed, and then the requests it failed to answer
+const DRAIN_TIMEOUT = time.Second * 5
+
+// set once the server starts shutting down, it is then no longer ready
+var shuttingDown atomic.Bool
+
+// serve the http requests on ln until ctx is done, then shut down the server and the broker
+func serve(ctx context.Context, srv *http.Server, ln net.Listener) error {
+	errs := make(chan error, 1)
+
+	go func() {
+		errs <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	shuttingDown.Store(true)
+
+	timeout, _ := parseDuration(currentConfig().Limits.ShutdownTimeout)
+	logger.Info("shutting down", "timeout", timeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	inFlight := srv.Shutdown(shutdownCtx) != nil
+
+	// the requests still blocked in the broker fail with ErrClosed
+	closeCtx, cancelClose := context.WithTimeout(context.Background(), DRAIN_TIMEOUT)
+	defer cancelClose()
+
+	if err := pb.Close(closeCtx); err != nil {
+		logger.Warn("draining the broker cut short", "err", err)
+	}
+
+	// they answer 503 before the connections are closed
+	if inFlight {
+		answerCtx, cancelAnswer := context.WithTimeout(context.Background(), DRAIN_TIMEOUT)
+		defer cancelAnswer()
+
+		if err := srv.Shutdown(answerCtx); err != nil {
+			logger.Warn("requests in flight cut short", "err", err)
+		}
+	}
+
+	srv.Close()
+
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	logger.Info("shut down")
+
+	return nil
+}
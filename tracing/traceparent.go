@@ -0,0 +1,106 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   The tracing package follows the messages from the publishers to the subscribers. The trace
+   context is a W3C traceparent stored with each message, the spans of its publish, enqueue,
+   dequeue and delivery are sent to a pluggable exporter.
+
+   This file contains the traceparent format:
+
+   00-<trace id, 32 hex digits>-<parent span id, 16 hex digits>-<flags, 2 hex digits>
+
+*/
+
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+var (
+	ErrInvalidTraceParent = errors.New("Invalid traceparent")
+)
+
+// a W3C trace context
+type TraceParent struct {
+	TraceID  string // 32 lowercase hex digits
+	ParentID string // 16 lowercase hex digits
+	Flags    string // 2 lowercase hex digits, "01" if sampled
+}
+
+// check that s is made of n lowercase hex digits, not all zero
+func validID(s string, n int) bool {
+	if len(s) != n || strings.Trim(s, "0") == "" {
+		return false
+	}
+
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parse a traceparent header. Versions after 00 are parsed as 00, ignoring the extra fields.
+func ParseTraceParent(s string) (TraceParent, error) {
+	parts := strings.Split(s, "-")
+
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return TraceParent{}, ErrInvalidTraceParent
+	}
+
+	if _, err := hex.DecodeString(parts[0]); err != nil || strings.ToLower(parts[0]) != parts[0] {
+		return TraceParent{}, ErrInvalidTraceParent
+	}
+
+	tp := TraceParent{TraceID: parts[1], ParentID: parts[2], Flags: parts[3]}
+
+	if !validID(tp.TraceID, 32) || !validID(tp.ParentID, 16) || len(tp.Flags) != 2 || !validID("1"+tp.Flags, 3) {
+		return TraceParent{}, ErrInvalidTraceParent
+	}
+
+	return tp, nil
+}
+
+func (tp TraceParent) String() string {
+	return "00-" + tp.TraceID + "-" + tp.ParentID + "-" + tp.Flags
+}
+
+// n random bytes in hex
+func randomID(n int) string {
+	b := make([]byte, n)
+
+	// crypto/rand does not fail on the supported platforms
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// a new span id
+func NewSpanID() string {
+	return randomID(8)
+}
+
+// a new sampled trace
+func NewTraceParent() TraceParent {
+	return TraceParent{TraceID: randomID(16), ParentID: NewSpanID(), Flags: "01"}
+}
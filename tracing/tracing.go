@@ -0,0 +1,186 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   This file contains the spans, the exporters and the tracing interceptor.
+
+   tracer := tracing.NewTracer(tracing.NewWriterExporter(os.Stdout))
+   pb.Use(tracing.Interceptor[string](tracer))
+
+*/
+
+package tracing
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/nakdesai/pub-sub/broker"
+)
+
+// the spans recorded for a message
+const (
+	PUBLISH = "publish" // the publish request, until the message is stored in its topic
+	ENQUEUE = "enqueue" // the message from its publish time, until it is stored and queued for the subscribers
+	DEQUEUE = "dequeue" // the message queued for a subscriber, until it is pulled
+	DELIVER = "deliver" // the message pulled, until it is sent to the subscriber
+)
+
+// a timed operation on a message
+type Span struct {
+	Name       string
+	TraceID    string
+	SpanID     string
+	ParentID   string `json:",omitempty"`
+	Topic      string
+	Subscriber string `json:",omitempty"`
+	MessageID  uint64 `json:",omitempty"`
+	Start      time.Time
+	Duration   time.Duration
+}
+
+// the trace context of the children of the span
+func (s *Span) TraceParent() string {
+	return TraceParent{TraceID: s.TraceID, ParentID: s.SpanID, Flags: "01"}.String()
+}
+
+// receives the finished spans, it must be safe for concurrent use
+type Exporter interface {
+	Export(span Span)
+}
+
+// an exporter writing the spans to w as json, one per line (for local testing, e.g. on stdout)
+type WriterExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{enc: json.NewEncoder(w)}
+}
+
+func (e *WriterExporter) Export(span Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.enc.Encode(span)
+}
+
+// maximum number of queued messages the tracer remembers, the oldest ones are forgotten first
+const MAX_QUEUED = 10000
+
+// a message queued in a topic
+type queuedKey struct {
+	topic string
+	id    uint64
+}
+
+// records the spans of the messages
+type Tracer struct {
+	exporter Exporter
+
+	mu     sync.Mutex
+	queued map[queuedKey]time.Time // when the messages were stored in their topic
+	ring   []queuedKey             // the keys of queued in the order they were stored
+	oldest int                     // index of the oldest key in ring once it is full
+}
+
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{exporter: exporter, queued: make(map[queuedKey]time.Time)}
+}
+
+// start a span as a child of the traceparent parent, or of a new trace if parent is not valid
+func (t *Tracer) Start(name, parent, topicName, subscriberName string, id uint64) *Span {
+	tp, err := ParseTraceParent(parent)
+	span := &Span{Name: name, SpanID: NewSpanID(), Topic: topicName, Subscriber: subscriberName, MessageID: id, Start: time.Now()}
+
+	if err != nil {
+		span.TraceID = NewTraceParent().TraceID
+	} else {
+		span.TraceID, span.ParentID = tp.TraceID, tp.ParentID
+	}
+
+	return span
+}
+
+// finish a span and export it
+func (t *Tracer) End(span *Span) {
+	span.Duration = time.Since(span.Start)
+	t.exporter.Export(*span)
+}
+
+// export a span started at start and finished now, the messages without a valid traceparent are not traced
+func (t *Tracer) Record(name, parent, topicName, subscriberName string, id uint64, start time.Time) {
+	t.record(name, parent, topicName, subscriberName, id, start, time.Now())
+}
+
+// export a span from start to end, the messages without a valid traceparent are not traced
+func (t *Tracer) record(name, parent, topicName, subscriberName string, id uint64, start, end time.Time) {
+	if _, err := ParseTraceParent(parent); err != nil {
+		return
+	}
+
+	span := t.Start(name, parent, topicName, subscriberName, id)
+	span.Start, span.Duration = start, end.Sub(start)
+	t.exporter.Export(*span)
+}
+
+// remember when a message was queued, forgetting the oldest one once MAX_QUEUED are remembered
+func (t *Tracer) queue(key queuedKey, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.ring) < MAX_QUEUED {
+		t.ring = append(t.ring, key)
+	} else {
+		delete(t.queued, t.ring[t.oldest])
+		t.ring[t.oldest] = key
+		t.oldest = (t.oldest + 1) % MAX_QUEUED
+	}
+
+	t.queued[key] = at
+}
+
+// the interceptor recording the enqueue and dequeue spans of the messages with a traceparent.
+// OnStore runs on the event loop, it only takes the time: both spans are exported on delivery
+// to each subscriber. The messages the tracer has forgotten are not traced.
+func Interceptor[T any](t *Tracer) broker.Interceptor[T] {
+	return broker.Interceptor[T]{
+		OnStore: func(topicName string, msg *broker.Message[T]) {
+			if msg.TraceParent != "" {
+				t.queue(queuedKey{topicName, msg.ID}, time.Now())
+			}
+		},
+		OnDeliver: func(topicName, subscriberName string, msg *broker.Message[T]) *broker.Message[T] {
+			if msg.TraceParent == "" {
+				return msg
+			}
+
+			t.mu.Lock()
+			queued, found := t.queued[queuedKey{topicName, msg.ID}]
+			t.mu.Unlock()
+
+			if found {
+				t.record(ENQUEUE, msg.TraceParent, topicName, subscriberName, msg.ID, msg.Published, queued)
+				t.record(DEQUEUE, msg.TraceParent, topicName, subscriberName, msg.ID, queued, time.Now())
+			}
+
+			return msg
+		},
+	}
+}
@@ -0,0 +1,178 @@
+/*
+   Copyright (C) 2016 Nakul Desai
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+   This file contains unit tests for the tracing package.
+
+   cmd to execute: "go test"
+
+*/
+
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nakdesai/pub-sub/broker"
+	"github.com/nakdesai/pub-sub/pubsub"
+)
+
+const TRACEPARENT = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// test the parsing of the traceparent headers
+func TestParseTraceParent(t *testing.T) {
+	tp, err := ParseTraceParent(TRACEPARENT)
+
+	if err != nil || tp.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || tp.ParentID != "00f067aa0ba902b7" || tp.Flags != "01" {
+		t.Errorf("Incorrect traceparent %+v, %v", tp, err)
+	}
+
+	if tp.String() != TRACEPARENT {
+		t.Errorf("expected %s, got %s", TRACEPARENT, tp)
+	}
+
+	// a later version may add fields
+	if _, err := ParseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"); err != nil {
+		t.Errorf("later version refused: %v", err)
+	}
+
+	for _, s := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1",
+	} {
+		if _, err := ParseTraceParent(s); err != ErrInvalidTraceParent {
+			t.Errorf("invalid traceparent %q not flagged", s)
+		}
+	}
+
+	if _, err := ParseTraceParent(NewTraceParent().String()); err != nil {
+		t.Errorf("invalid new traceparent: %v", err)
+	}
+}
+
+// collects the spans
+type collector struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+func (c *collector) Export(span Span) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.spans = append(c.spans, span)
+}
+
+// test the enqueue and dequeue spans recorded by the interceptor
+func TestInterceptor(t *testing.T) {
+	c := &collector{}
+	pb, _ := pubsub.New[string]()
+	defer pb.Close(context.Background())
+
+	ic := Interceptor[string](NewTracer(c))
+	pb.Use(ic)
+	pb.Subscribe("topic", "sub1")
+
+	// the store hook runs on the event loop, it does not export
+	ic.OnStore("other", &broker.PubMessage{Message: "queued", TraceParent: TRACEPARENT, ID: 1})
+
+	if len(c.spans) != 0 {
+		t.Errorf("spans exported on store: %+v", c.spans)
+	}
+
+	published := time.Now().Add(-time.Millisecond * 10)
+	pb.Publish("topic", &broker.PubMessage{Message: "traced", Published: published, TraceParent: TRACEPARENT})
+	pb.Publish("topic", &broker.PubMessage{Message: "untraced", Published: published})
+
+	// the message waits in the topic for its subscriber
+	<-time.After(time.Millisecond * 10)
+
+	pb.Get("topic", "sub1")
+	pb.Get("topic", "sub1")
+
+	if len(c.spans) != 2 {
+		t.Fatalf("expected the enqueue and dequeue spans, got %+v", c.spans)
+	}
+
+	for i, name := range []string{ENQUEUE, DEQUEUE} {
+		span := c.spans[i]
+
+		if span.Name != name || span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || span.ParentID != "00f067aa0ba902b7" ||
+			span.Topic != "topic" || span.Subscriber != "sub1" || span.MessageID != 1 {
+			t.Errorf("Incorrect %s span %+v", name, span)
+		}
+	}
+
+	if !c.spans[0].Start.Equal(published) || c.spans[0].Duration < time.Millisecond*10 {
+		t.Errorf("the enqueue span does not start on publish: %+v", c.spans[0])
+	}
+
+	if !c.spans[1].Start.Equal(c.spans[0].Start.Add(c.spans[0].Duration)) || c.spans[1].Duration < time.Millisecond*10 {
+		t.Errorf("the dequeue span does not cover the wait for the subscriber: %+v", c.spans[1])
+	}
+}
+
+// test that the tracer forgets the oldest queued messages instead of the new ones
+func TestQueued(t *testing.T) {
+	tracer := NewTracer(&collector{})
+	ic := Interceptor[string](tracer)
+
+	for id := uint64(1); id <= MAX_QUEUED+1; id++ {
+		ic.OnStore("topic", &broker.PubMessage{TraceParent: TRACEPARENT, ID: id})
+	}
+
+	_, first := tracer.queued[queuedKey{"topic", 1}]
+	_, last := tracer.queued[queuedKey{"topic", MAX_QUEUED + 1}]
+
+	if len(tracer.queued) != MAX_QUEUED || first || !last {
+		t.Errorf("expected the %d newest messages, got %d (first %v, last %v)", MAX_QUEUED, len(tracer.queued), first, last)
+	}
+}
+
+// test that the writer exporter writes a json object per line
+func TestWriterExporter(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewWriterExporter(&buf)
+
+	e.Export(Span{Name: PUBLISH, TraceID: "t1", SpanID: "s1", Topic: "topic"})
+	e.Export(Span{Name: DELIVER, TraceID: "t1", SpanID: "s2", Topic: "topic", Subscriber: "sub1"})
+
+	if lines := bytes.Count(buf.Bytes(), []byte("\n")); lines != 2 {
+		t.Fatalf("expected a line per span, got %q", buf.String())
+	}
+
+	dec := json.NewDecoder(&buf)
+
+	for _, want := range []string{"s1", "s2"} {
+		var span Span
+
+		if err := dec.Decode(&span); err != nil || span.SpanID != want {
+			t.Errorf("expected span %s, got %+v, %v", want, span, err)
+		}
+	}
+}